@@ -2,6 +2,7 @@ package file
 
 import (
 	"context"
+	"time"
 
 	gv1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/partial"
@@ -10,6 +11,7 @@ import (
 	"github.com/rancherfederal/ocil/pkg/artifacts"
 	"github.com/rancherfederal/ocil/pkg/artifacts/file/getter"
 	"github.com/rancherfederal/ocil/pkg/consts"
+	"github.com/rancherfederal/ocil/pkg/layer"
 )
 
 // interface guard
@@ -26,6 +28,7 @@ type File struct {
 	blob        gv1.Layer
 	manifest    *gv1.Manifest
 	annotations map[string]string
+	budget      time.Duration
 }
 
 func NewFile(path string, opts ...Option) *File {
@@ -85,7 +88,14 @@ func (f *File) compute() error {
 		return err
 	}
 
-	layer, err := partial.Descriptor(blob)
+	if f.budget > 0 {
+		blob, err = layer.Compress(blob, f.budget)
+		if err != nil {
+			return err
+		}
+	}
+
+	blobDesc, err := partial.Descriptor(blob)
 	if err != nil {
 		return err
 	}
@@ -104,7 +114,7 @@ func (f *File) compute() error {
 		SchemaVersion: 2,
 		MediaType:     gtypes.MediaType(f.MediaType()),
 		Config:        *cfgDesc,
-		Layers:        []gv1.Descriptor{*layer},
+		Layers:        []gv1.Descriptor{*blobDesc},
 		Annotations:   f.annotations,
 	}
 
@@ -2,6 +2,7 @@ package file_test
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
 	"io"
 	"net/http"
@@ -10,12 +11,15 @@ import (
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/spf13/afero"
 
 	"github.com/rancherfederal/ocil/pkg/artifacts/file"
 	"github.com/rancherfederal/ocil/pkg/artifacts/file/getter"
 	"github.com/rancherfederal/ocil/pkg/consts"
+	"github.com/rancherfederal/ocil/pkg/layer"
 )
 
 var (
@@ -121,6 +125,48 @@ func Test_file_Layers(t *testing.T) {
 	}
 }
 
+func Test_file_CompressionBudget(t *testing.T) {
+	f := file.NewFile(filename, file.WithClient(mc), file.WithCompressionBudget(time.Hour))
+
+	m, err := f.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	desc := m.Layers[0]
+
+	if got := desc.Annotations[consts.CompressionCodecAnnotation]; got != layer.CodecGzip {
+		t.Errorf("unexpected codec: got %s, want %s", got, layer.CodecGzip)
+	}
+	if want := consts.FileLayerMediaType + "+" + layer.CodecGzip; string(desc.MediaType) != want {
+		t.Errorf("unexpected media type: got %s, want %s", desc.MediaType, want)
+	}
+	if got := desc.Annotations[ocispec.AnnotationTitle]; got != filename {
+		t.Errorf("expected the title annotation to be kept: got %s, want %s", got, filename)
+	}
+
+	layers, err := f.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	rc, err := layers[0].Compressed()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	zr, err := gzip.NewReader(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("unexpected decompressed content: got %s, want %s", got, data)
+	}
+}
+
 func setup() func() {
 	tfs = afero.NewMemMapFs()
 	afero.WriteFile(tfs, filename, data, 0644)
@@ -1,6 +1,8 @@
 package file
 
 import (
+	"time"
+
 	"github.com/rancherfederal/ocil/pkg/artifacts"
 	"github.com/rancherfederal/ocil/pkg/artifacts/file/getter"
 )
@@ -24,3 +26,10 @@ func WithAnnotations(m map[string]string) Option {
 		f.annotations = m
 	}
 }
+
+// WithCompressionBudget compresses the file's content, adapting the compression setting to finish within budget
+func WithCompressionBudget(budget time.Duration) Option {
+	return func(f *File) {
+		f.budget = budget
+	}
+}
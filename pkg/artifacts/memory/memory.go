@@ -1,6 +1,8 @@
 package memory
 
 import (
+	"time"
+
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/partial"
 	"github.com/google/go-containerregistry/pkg/v1/static"
@@ -8,6 +10,7 @@ import (
 
 	"github.com/rancherfederal/ocil/pkg/artifacts"
 	"github.com/rancherfederal/ocil/pkg/consts"
+	"github.com/rancherfederal/ocil/pkg/layer"
 )
 
 var _ artifacts.OCI = (*Memory)(nil)
@@ -17,6 +20,9 @@ type Memory struct {
 	blob        v1.Layer
 	annotations map[string]string
 	config      artifacts.Config
+
+	budget     time.Duration
+	compressed bool
 }
 
 type defaultConfig struct {
@@ -43,6 +49,10 @@ func (m *Memory) MediaType() string {
 }
 
 func (m *Memory) Manifest() (*v1.Manifest, error) {
+	if err := m.compress(); err != nil {
+		return nil, err
+	}
+
 	layer, err := partial.Descriptor(m.blob)
 	if err != nil {
 		return nil, err
@@ -72,7 +82,27 @@ func (m *Memory) RawConfig() ([]byte, error) {
 }
 
 func (m *Memory) Layers() ([]v1.Layer, error) {
+	if err := m.compress(); err != nil {
+		return nil, err
+	}
+
 	var layers []v1.Layer
 	layers = append(layers, m.blob)
 	return layers, nil
 }
+
+// compress replaces the blob with its compressed form once, if a compression budget was given
+func (m *Memory) compress() error {
+	if m.budget <= 0 || m.compressed {
+		return nil
+	}
+
+	blob, err := layer.Compress(m.blob, m.budget)
+	if err != nil {
+		return err
+	}
+
+	m.blob = blob
+	m.compressed = true
+	return nil
+}
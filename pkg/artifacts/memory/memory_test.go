@@ -1,13 +1,22 @@
 package memory_test
 
 import (
+	"bytes"
+	"compress/gzip"
+	"io"
 	"math/rand"
+	"os"
+	"strconv"
 	"testing"
+	"time"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/klauspost/compress/zstd"
 	"github.com/opencontainers/go-digest"
 
 	"github.com/rancherfederal/ocil/pkg/artifacts/memory"
+	"github.com/rancherfederal/ocil/pkg/consts"
+	"github.com/rancherfederal/ocil/pkg/layer"
 )
 
 func TestMemory_Layers(t *testing.T) {
@@ -49,6 +58,90 @@ func TestMemory_Layers(t *testing.T) {
 	}
 }
 
+func TestMemory_CompressionBudget(t *testing.T) {
+	// large and compressible enough that the strongest settings take measurable time
+	data := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 1<<17)
+
+	tests := []struct {
+		name      string
+		budget    time.Duration
+		wantCodec string
+		wantLevel int
+	}{
+		{
+			name:      "should fall back to the fastest codec with a tight budget",
+			budget:    time.Nanosecond,
+			wantCodec: layer.CodecZstd,
+			wantLevel: int(zstd.SpeedFastest),
+		},
+		{
+			name:      "should use the strongest setting with a generous budget",
+			budget:    time.Hour,
+			wantCodec: layer.CodecGzip,
+			wantLevel: gzip.BestCompression,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := memory.NewMemory(data, "text/plain", memory.WithCompressionBudget(tt.budget))
+
+			manifest, err := m.Manifest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			desc := manifest.Layers[0]
+
+			if got := desc.Annotations[consts.CompressionCodecAnnotation]; got != tt.wantCodec {
+				t.Errorf("unexpected codec: got %s, want %s", got, tt.wantCodec)
+			}
+			if got := desc.Annotations[consts.CompressionLevelAnnotation]; got != strconv.Itoa(tt.wantLevel) {
+				t.Errorf("unexpected level: got %s, want %d", got, tt.wantLevel)
+			}
+			if want := "text/plain+" + tt.wantCodec; string(desc.MediaType) != want {
+				t.Errorf("unexpected media type: got %s, want %s", desc.MediaType, want)
+			}
+
+			layers, err := m.Layers()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			rc, err := layers[0].Compressed()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer rc.Close()
+
+			var zr io.Reader
+			switch tt.wantCodec {
+			case layer.CodecGzip:
+				zr, err = gzip.NewReader(rc)
+			case layer.CodecZstd:
+				zr, err = zstd.NewReader(rc)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := io.ReadAll(zr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Fatal("decompressed content does not match original")
+			}
+
+			d, err := layers[0].DiffID()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := digest.FromBytes(data); d.String() != want.String() {
+				t.Errorf("unexpected diffID: got %s, want %s", d, want)
+			}
+		})
+	}
+}
+
 func setup(t *testing.T) ([]byte, *memory.Memory) {
 	block := make([]byte, 2048)
 	_, err := rand.Read(block)
@@ -59,3 +152,58 @@ func setup(t *testing.T) ([]byte, *memory.Memory) {
 	mem := memory.NewMemory(block, "random")
 	return block, mem
 }
+
+func TestMemory_CompressionBudget_CompressedMediaType(t *testing.T) {
+	m := memory.NewMemory([]byte("layer"), "application/vnd.oci.image.layer.v1.tar+gzip", memory.WithCompressionBudget(time.Nanosecond))
+
+	manifest, err := m.Manifest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(manifest.Layers[0].MediaType), "application/vnd.oci.image.layer.v1.tar+zstd"; got != want {
+		t.Errorf("unexpected media type: got %s, want %s", got, want)
+	}
+}
+
+func TestMemory_CompressionBudget_NoTempFiles(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+
+	data := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 1<<14)
+	for _, budget := range []time.Duration{time.Nanosecond, time.Hour} {
+		m := memory.NewMemory(data, "text/plain", memory.WithCompressionBudget(budget))
+
+		layers, err := m.Layers()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want, err := layers[0].Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// every read of the compressed content reproduces the measured digest
+		for i := 0; i < 2; i++ {
+			rc, err := layers[0].Compressed()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _, err := v1.SHA256(rc)
+			rc.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("unexpected compressed digest: got %s, want %s", got, want)
+			}
+		}
+	}
+
+	entries, err := os.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 0 {
+		t.Errorf("expected no temporary files to remain, got %d", len(entries))
+	}
+}
@@ -1,6 +1,10 @@
 package memory
 
-import "github.com/rancherfederal/ocil/pkg/artifacts"
+import (
+	"time"
+
+	"github.com/rancherfederal/ocil/pkg/artifacts"
+)
 
 type Option func(*Memory)
 
@@ -15,3 +19,10 @@ func WithAnnotations(annotations map[string]string) Option {
 		m.annotations = annotations
 	}
 }
+
+// WithCompressionBudget compresses the blob, adapting the compression setting to finish within budget
+func WithCompressionBudget(budget time.Duration) Option {
+	return func(m *Memory) {
+		m.budget = budget
+	}
+}
@@ -27,6 +27,9 @@ type OCI struct {
 	root    string
 	index   *ocispec.Index
 	nameMap *sync.Map // map[string]ocispec.Descriptor
+
+	// mu serializes loading and updating the index
+	mu sync.Mutex
 }
 
 func NewOCI(root string) (*OCI, error) {
@@ -43,12 +46,56 @@ func (o *OCI) AddIndex(desc ocispec.Descriptor) error {
 	if _, ok := desc.Annotations[ocispec.AnnotationRefName]; !ok {
 		return fmt.Errorf("descriptor must contain a reference from the annotation: %s", ocispec.AnnotationRefName)
 	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
 	o.nameMap.Store(desc.Annotations[ocispec.AnnotationRefName], desc)
-	return o.SaveIndex()
+	return o.saveIndex()
+}
+
+// AddIndexes adds several descriptors to the index and updates it once
+// 	Every descriptor must use AnnotationRefName to identify itself, if any do not, or the index fails to save, the
+// 	index is left unchanged
+func (o *OCI) AddIndexes(descs ...ocispec.Descriptor) error {
+	for _, desc := range descs {
+		if _, ok := desc.Annotations[ocispec.AnnotationRefName]; !ok {
+			return fmt.Errorf("descriptor must contain a reference from the annotation: %s", ocispec.AnnotationRefName)
+		}
+	}
+
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	prev := make(map[string]interface{}, len(descs))
+	for _, desc := range descs {
+		name := desc.Annotations[ocispec.AnnotationRefName]
+		if _, ok := prev[name]; !ok {
+			old, _ := o.nameMap.Load(name)
+			prev[name] = old
+		}
+		o.nameMap.Store(name, desc)
+	}
+
+	if err := o.saveIndex(); err != nil {
+		for name, old := range prev {
+			if old == nil {
+				o.nameMap.Delete(name)
+			} else {
+				o.nameMap.Store(name, old)
+			}
+		}
+		return err
+	}
+	return nil
 }
 
 // LoadIndex will load the index from disk
 func (o *OCI) LoadIndex() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.loadIndex()
+}
+
+func (o *OCI) loadIndex() error {
 	path := o.path(consts.OCIImageIndexFile)
 	idx, err := os.Open(path)
 	if err != nil {
@@ -77,16 +124,26 @@ func (o *OCI) LoadIndex() error {
 }
 
 // SaveIndex will update the index on disk
+// 	The index is written to a temporary file and renamed into place so readers never observe a partial index
 func (o *OCI) SaveIndex() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.saveIndex()
+}
+
+func (o *OCI) saveIndex() error {
 	var descs []ocispec.Descriptor
 	o.nameMap.Range(func(name, desc interface{}) bool {
 		n := name.(string)
 		d := desc.(ocispec.Descriptor)
 
-		if d.Annotations == nil {
-			d.Annotations = make(map[string]string)
+		// the stored descriptor's annotations may be shared, so never modify them in place
+		annotations := make(map[string]string, len(d.Annotations)+1)
+		for k, v := range d.Annotations {
+			annotations[k] = v
 		}
-		d.Annotations[ocispec.AnnotationRefName] = n
+		annotations[ocispec.AnnotationRefName] = n
+		d.Annotations = annotations
 		descs = append(descs, d)
 		return true
 	})
@@ -95,7 +152,11 @@ func (o *OCI) SaveIndex() error {
 	if err != nil {
 		return err
 	}
-	return os.WriteFile(o.path(consts.OCIImageIndexFile), data, 0644)
+	tmp := o.path(consts.OCIImageIndexFile + ".tmp")
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, o.path(consts.OCIImageIndexFile))
 }
 
 // Resolve attempts to resolve the reference into a name and descriptor.
@@ -181,6 +242,17 @@ func (o *OCI) Walk(fn func(reference string, desc ocispec.Descriptor) error) err
 	return nil
 }
 
+// markRoot reloads the index and saves it with ref added as d, without another update landing in between
+func (o *OCI) markRoot(ref string, d ocispec.Descriptor) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.loadIndex(); err != nil {
+		return err
+	}
+	o.nameMap.Store(ref, d)
+	return o.saveIndex()
+}
+
 func (o *OCI) blobReaderAt(desc ocispec.Descriptor) (*os.File, error) {
 	blobPath, err := o.ensureBlob(desc.Digest.Algorithm().String(), desc.Digest.Hex())
 	if err != nil {
@@ -223,11 +295,7 @@ func (p *ociPusher) Push(ctx context.Context, d ocispec.Descriptor) (ccontent.Wr
 	case ocispec.MediaTypeImageManifest, ocispec.MediaTypeImageIndex, consts.DockerManifestSchema2:
 		// if the hash of the content matches that which was provided as the hash for the root, mark it
 		if p.digest != "" && p.digest == d.Digest.String() {
-			if err := p.oci.LoadIndex(); err != nil {
-				return nil, err
-			}
-			p.oci.nameMap.Store(p.ref, d)
-			if err := p.oci.SaveIndex(); err != nil {
+			if err := p.oci.markRoot(p.ref, d); err != nil {
 				return nil, err
 			}
 		}
@@ -0,0 +1,271 @@
+package layer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
+	gtypes "github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/klauspost/compress/zstd"
+
+	"github.com/rancherfederal/ocil/pkg/consts"
+)
+
+const (
+	CodecGzip = "gzip"
+	CodecZstd = "zstd"
+
+	// compressSampleSize is the number of leading uncompressed bytes used to measure each setting's throughput
+	compressSampleSize = 256 << 10
+)
+
+// Compression identifies the codec and level a layer was compressed with
+type Compression struct {
+	Codec string
+	Level int
+}
+
+// compressions are the candidate settings, ordered from smallest output to fastest
+var compressions = []Compression{
+	{Codec: CodecGzip, Level: gzip.BestCompression},
+	{Codec: CodecGzip, Level: gzip.DefaultCompression},
+	{Codec: CodecGzip, Level: gzip.BestSpeed},
+	{Codec: CodecZstd, Level: int(zstd.SpeedFastest)},
+}
+
+var errBudgetExceeded = errors.New("compression time budget exceeded")
+
+func (c Compression) writer(w io.Writer) (io.WriteCloser, error) {
+	switch c.Codec {
+	case CodecGzip:
+		return gzip.NewWriterLevel(w, c.Level)
+	case CodecZstd:
+		// a single encoder goroutine keeps the output identical from one run to the next
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevel(c.Level)), zstd.WithEncoderConcurrency(1))
+	}
+	return nil, fmt.Errorf("unknown codec: %s", c.Codec)
+}
+
+// Compress compresses the uncompressed content of l, choosing the strongest setting expected to finish within budget
+// 	Each candidate setting is timed against a sample of the content and the result is extrapolated to l.Size().  That
+// 	is the uncompressed size for layers from this package and static layers, for any other layer it is only an
+// 	estimate.  The chosen setting then compresses all of the content once to measure the result, and if that still runs
+// 	over budget it is aborted and the content read again with the fastest setting.  Nothing is staged, the returned
+// 	layer compresses its content again each time Compressed is read.  Whichever setting is used is recorded in the
+// 	layer's annotations and its media type gains the matching +gzip or +zstd suffix, replacing any it already had.
+func Compress(l v1.Layer, budget time.Duration) (v1.Layer, error) {
+	deadline := time.Now().Add(budget)
+	fastest := compressions[len(compressions)-1]
+
+	rc, err := l.Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	sample, err := ioutil.ReadAll(io.LimitReader(rc, compressSampleSize))
+	if err != nil {
+		return nil, err
+	}
+	size := int64(len(sample))
+	if size == compressSampleSize {
+		if size, err = l.Size(); err != nil {
+			return nil, err
+		}
+	}
+
+	c, err := chooseCompression(sample, size, budget)
+	if err != nil {
+		return nil, err
+	}
+	if c == fastest {
+		// there is nothing faster to fall back to
+		deadline = time.Time{}
+	}
+
+	cl, err := measure(io.MultiReader(bytes.NewReader(sample), rc), c, deadline)
+	if errors.Is(err, errBudgetExceeded) {
+		rc.Close()
+		if rc, err = l.Uncompressed(); err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+
+		c = fastest
+		cl, err = measure(rc, c, time.Time{})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	mt, err := l.MediaType()
+	if err != nil {
+		return nil, err
+	}
+	base := strings.TrimSuffix(strings.TrimSuffix(string(mt), "+"+CodecGzip), "+"+CodecZstd)
+
+	annotations := make(map[string]string)
+	if desc, err := partial.Descriptor(l); err == nil {
+		for k, v := range desc.Annotations {
+			annotations[k] = v
+		}
+	}
+	annotations[consts.CompressionCodecAnnotation] = c.Codec
+	annotations[consts.CompressionLevelAnnotation] = strconv.Itoa(c.Level)
+
+	cl.inner = l
+	cl.mediaType = gtypes.MediaType(base + "+" + c.Codec)
+	cl.annotations = annotations
+	return cl, nil
+}
+
+// chooseCompression returns the first of compressions whose time for sample, projected to size bytes, fits in budget
+func chooseCompression(sample []byte, size int64, budget time.Duration) (Compression, error) {
+	if len(sample) == 0 {
+		return compressions[0], nil
+	}
+	scale := float64(size) / float64(len(sample))
+
+	for _, c := range compressions[:len(compressions)-1] {
+		t := time.Now()
+		w, err := c.writer(ioutil.Discard)
+		if err != nil {
+			return Compression{}, err
+		}
+		if _, err := w.Write(sample); err != nil {
+			return Compression{}, err
+		}
+		if err := w.Close(); err != nil {
+			return Compression{}, err
+		}
+
+		if time.Duration(float64(time.Since(t))*scale) <= budget {
+			return c, nil
+		}
+	}
+	return compressions[len(compressions)-1], nil
+}
+
+// measure compresses r with c without keeping the output, returning a layer with its digests and size
+func measure(r io.Reader, c Compression, deadline time.Time) (*compressedLayer, error) {
+	zh := sha256.New()
+	cw := &countingWriter{w: zh}
+	diffID, err := compressWithin(cw, r, c, deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	return &compressedLayer{
+		digest:      v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(zh.Sum(nil))},
+		diffID:      diffID,
+		size:        cw.n,
+		compression: c,
+	}, nil
+}
+
+// compressWithin compresses r with c into w, giving up once deadline has passed
+// 	A zero deadline never expires.  The sha256 of the uncompressed content is returned.
+func compressWithin(w io.Writer, r io.Reader, c Compression, deadline time.Time) (v1.Hash, error) {
+	zw, err := c.writer(w)
+	if err != nil {
+		return v1.Hash{}, err
+	}
+
+	h := sha256.New()
+	r = io.TeeReader(r, h)
+	chunk := make([]byte, 32<<10)
+	for {
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			zw.Close()
+			return v1.Hash{}, errBudgetExceeded
+		}
+
+		n, err := r.Read(chunk)
+		if n > 0 {
+			if _, err := zw.Write(chunk[:n]); err != nil {
+				zw.Close()
+				return v1.Hash{}, err
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			zw.Close()
+			return v1.Hash{}, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return v1.Hash{}, err
+	}
+	return v1.Hash{Algorithm: "sha256", Hex: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
+
+// compressedLayer is a layer whose content is compressed as it is read
+// 	Compression is deterministic, so every read produces exactly the content measured by Compress.
+type compressedLayer struct {
+	inner       v1.Layer
+	digest      v1.Hash
+	diffID      v1.Hash
+	size        int64
+	mediaType   gtypes.MediaType
+	annotations map[string]string
+	compression Compression
+}
+
+// Compression returns the setting the layer was compressed with
+func (l *compressedLayer) Compression() Compression {
+	return l.compression
+}
+
+func (l *compressedLayer) Descriptor() (*v1.Descriptor, error) {
+	return &v1.Descriptor{
+		MediaType:   l.mediaType,
+		Size:        l.size,
+		Digest:      l.digest,
+		Annotations: l.annotations,
+	}, nil
+}
+
+func (l *compressedLayer) Compressed() (io.ReadCloser, error) {
+	rc, err := l.inner.Uncompressed()
+	if err != nil {
+		return nil, err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		defer rc.Close()
+		_, err := compressWithin(pw, rc, l.compression, time.Time{})
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+func (l *compressedLayer) Uncompressed() (io.ReadCloser, error) { return l.inner.Uncompressed() }
+func (l *compressedLayer) Digest() (v1.Hash, error)             { return l.digest, nil }
+func (l *compressedLayer) DiffID() (v1.Hash, error)             { return l.diffID, nil }
+func (l *compressedLayer) Size() (int64, error)                 { return l.size, nil }
+func (l *compressedLayer) MediaType() (gtypes.MediaType, error) { return l.mediaType, nil }
@@ -0,0 +1,274 @@
+package store
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/opencontainers/go-digest"
+)
+
+// DefaultCheckpointInterval is the number of bytes written between blob write checkpoints
+const DefaultCheckpointInterval = 64 << 20
+
+// WithCheckpointInterval sets the number of bytes written between checkpoints of in-progress blob writes
+func WithCheckpointInterval(n int64) Options {
+	return func(l *Layout) {
+		l.checkpointInterval = n
+	}
+}
+
+// keyedMutex provides a mutex per key, so writers of the same blob are serialized while others proceed
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyedLock
+}
+
+type keyedLock struct {
+	sync.Mutex
+	waiters int
+}
+
+// lock blocks until key is free and returns the function that frees it again
+func (k *keyedMutex) lock(key string) func() {
+	k.mu.Lock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyedLock)
+	}
+	kl, ok := k.locks[key]
+	if !ok {
+		kl = &keyedLock{}
+		k.locks[key] = kl
+	}
+	kl.waiters++
+	k.mu.Unlock()
+
+	kl.Lock()
+	return func() {
+		kl.Unlock()
+
+		k.mu.Lock()
+		defer k.mu.Unlock()
+		kl.waiters--
+		if kl.waiters == 0 {
+			delete(k.locks, key)
+		}
+	}
+}
+
+// checkpoint is the on disk record of an in-progress blob write
+type checkpoint struct {
+	// Offset is the number of bytes of the blob safely written to the ingest file
+	Offset int64 `json:"offset"`
+
+	// Hash is the marshalled state of the blob's hash after Offset bytes
+	Hash []byte `json:"hash"`
+}
+
+// ingest is a blob write in progress, staged outside of the blobs directory until its digest is verified
+type ingest struct {
+	f        *os.File
+	h        hash.Hash
+	path     string
+	cpPath   string
+	offset   int64
+	interval int64
+	unsaved  int64
+	resumed  bool
+}
+
+// openIngest opens the ingest file for the blob identified by d, resuming from its last checkpoint if there is one
+func (l *Layout) openIngest(d v1.Hash) (*ingest, error) {
+	dir := filepath.Join(l.Root, "ingest", d.Algorithm)
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil && !os.IsExist(err) {
+		return nil, err
+	}
+
+	alg := digest.Algorithm(d.Algorithm)
+	if !alg.Available() {
+		return nil, fmt.Errorf("unsupported digest algorithm: %s", d.Algorithm)
+	}
+
+	interval := l.checkpointInterval
+	if interval <= 0 {
+		interval = DefaultCheckpointInterval
+	}
+
+	in := &ingest{
+		h:        alg.Hash(),
+		path:     filepath.Join(dir, d.Hex),
+		cpPath:   filepath.Join(dir, d.Hex+".checkpoint"),
+		interval: interval,
+	}
+
+	f, err := os.OpenFile(in.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	in.f = f
+
+	// anything that prevents resuming simply restarts the write from the beginning
+	if err := in.resume(); err != nil {
+		in.offset = 0
+		in.h.Reset()
+	}
+	in.resumed = in.offset > 0
+	if err := f.Truncate(in.offset); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if _, err := f.Seek(in.offset, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return in, nil
+}
+
+func (in *ingest) resume() error {
+	data, err := ioutil.ReadFile(in.cpPath)
+	if err != nil {
+		return err
+	}
+
+	var cp checkpoint
+	if err := json.Unmarshal(data, &cp); err != nil {
+		return err
+	}
+
+	fi, err := in.f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() < cp.Offset {
+		return fmt.Errorf("ingest is shorter than checkpoint: %d < %d", fi.Size(), cp.Offset)
+	}
+
+	u, ok := in.h.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return fmt.Errorf("hash state cannot be restored")
+	}
+	if err := u.UnmarshalBinary(cp.Hash); err != nil {
+		return err
+	}
+
+	in.offset = cp.Offset
+	return nil
+}
+
+// skip advances r past the bytes already present in the ingest file
+func (in *ingest) skip(r io.Reader) error {
+	if in.offset == 0 {
+		return nil
+	}
+	if s, ok := r.(io.Seeker); ok {
+		_, err := s.Seek(in.offset, io.SeekStart)
+		return err
+	}
+	_, err := io.CopyN(ioutil.Discard, r, in.offset)
+	return err
+}
+
+func (in *ingest) Write(p []byte) (int, error) {
+	n, err := in.f.Write(p)
+	in.h.Write(p[:n])
+	in.offset += int64(n)
+	in.unsaved += int64(n)
+	if err != nil {
+		return n, err
+	}
+
+	if in.unsaved >= in.interval {
+		if err := in.checkpoint(); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// checkpoint syncs the ingest file and records the current offset and hash state
+func (in *ingest) checkpoint() error {
+	m, ok := in.h.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil
+	}
+	state, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	if err := in.f.Sync(); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(checkpoint{Offset: in.offset, Hash: state})
+	if err != nil {
+		return err
+	}
+
+	tmp := in.cpPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, in.cpPath); err != nil {
+		return err
+	}
+
+	in.unsaved = 0
+	return nil
+}
+
+// commit verifies the written content matches d and moves it to blobPath
+// 	The running hash only covers the bytes that passed through this process, so a resumed write is also re-read from
+// 	disk to catch a prefix that changed after it was checkpointed.
+func (in *ingest) commit(d v1.Hash, blobPath string) error {
+	if err := in.f.Close(); err != nil {
+		return err
+	}
+
+	if got := fmt.Sprintf("%x", in.h.Sum(nil)); got != d.Hex {
+		in.discard()
+		return fmt.Errorf("digest mismatch: got %s:%s, expected %s", d.Algorithm, got, d)
+	}
+
+	if in.resumed {
+		if err := checkBlob(in.path, digest.Digest(d.String())); err != nil {
+			in.discard()
+			return fmt.Errorf("resumed ingest: %w", err)
+		}
+	}
+
+	if err := os.Rename(in.path, blobPath); err != nil {
+		return err
+	}
+	return os.RemoveAll(in.cpPath)
+}
+
+// abort checkpoints the write so far so a later write of the same blob can resume from it
+func (in *ingest) abort() error {
+	defer in.f.Close()
+	return in.checkpoint()
+}
+
+// removeIngest removes any partial write of the blob identified by d along with its checkpoint
+func (l *Layout) removeIngest(d digest.Digest) error {
+	path := filepath.Join(l.Root, "ingest", d.Algorithm().String(), d.Hex())
+	for _, p := range []string{path, path + ".checkpoint", path + ".checkpoint.tmp"} {
+		if err := os.RemoveAll(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (in *ingest) discard() {
+	in.f.Close()
+	os.RemoveAll(in.path)
+	os.RemoveAll(in.cpPath)
+}
@@ -0,0 +1,291 @@
+package store_test
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/rancherfederal/ocil/pkg/artifacts/memory"
+	"github.com/rancherfederal/ocil/pkg/store"
+)
+
+func TestLayout_AddOCI_ResumesInterruptedWrite(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	s, err := store.NewLayout(root, store.WithCheckpointInterval(64<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 4<<20)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	base := static.NewLayer(data, types.OCIUncompressedLayer)
+	d, err := base.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	blobPath := filepath.Join(root, "blobs", d.Algorithm, d.Hex)
+
+	// interrupt the write about halfway through
+	broken := &controlledLayer{Layer: base, data: data, failAt: 2 << 20}
+	if _, err := s.AddOCI(ctx, newLayersArtifact(broken), "large/blob:v1"); err == nil {
+		t.Fatal("expected interrupted write to fail")
+	}
+	if _, err := os.Stat(blobPath); !os.IsNotExist(err) {
+		t.Fatalf("expected no blob after interrupted write, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "ingest", d.Algorithm, d.Hex+".checkpoint")); err != nil {
+		t.Fatalf("expected checkpoint after interrupted write: %v", err)
+	}
+
+	resumed := &controlledLayer{Layer: base, data: data, failAt: -1}
+	if _, err := s.AddOCI(ctx, newLayersArtifact(resumed), "large/blob:v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if resumed.seekedTo == 0 {
+		t.Error("expected write to resume from checkpoint rather than restart")
+	}
+
+	got, err := os.ReadFile(blobPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("resumed blob does not match original content")
+	}
+	if gd := digest.FromBytes(got); gd.String() != d.String() {
+		t.Fatalf("unexpected blob digest: got %s, want %s", gd, d)
+	}
+	if _, err := os.Stat(filepath.Join(root, "ingest", d.Algorithm, d.Hex)); !os.IsNotExist(err) {
+		t.Errorf("expected ingest to be cleaned up, got %v", err)
+	}
+}
+
+func TestLayout_AddOCI_RejectsCorruptResume(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	s, err := store.NewLayout(root, store.WithCheckpointInterval(64<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 1<<20)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	base := static.NewLayer(data, types.OCIUncompressedLayer)
+
+	broken := &controlledLayer{Layer: base, data: data, failAt: 512 << 10}
+	if _, err := s.AddOCI(ctx, newLayersArtifact(broken), "large/blob:v1"); err == nil {
+		t.Fatal("expected interrupted write to fail")
+	}
+
+	// the remainder of the content no longer matches what was checkpointed
+	tampered := append([]byte{}, data...)
+	tampered[len(tampered)-1] ^= 0xff
+	resumed := &controlledLayer{Layer: base, data: tampered, failAt: -1}
+	if _, err := s.AddOCI(ctx, newLayersArtifact(resumed), "large/blob:v1"); err == nil {
+		t.Fatal("expected digest verification to fail")
+	}
+
+	d, err := base.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "blobs", d.Algorithm, d.Hex)); !os.IsNotExist(err) {
+		t.Fatalf("expected no blob after failed verification, got %v", err)
+	}
+}
+
+func TestLayout_AddOCI_RejectsTamperedIngest(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	s, err := store.NewLayout(root, store.WithCheckpointInterval(64<<10))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 1<<20)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	base := static.NewLayer(data, types.OCIUncompressedLayer)
+	d, err := base.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broken := &controlledLayer{Layer: base, data: data, failAt: 512 << 10}
+	if _, err := s.AddOCI(ctx, newLayersArtifact(broken), "large/blob:v1"); err == nil {
+		t.Fatal("expected interrupted write to fail")
+	}
+
+	// the already checkpointed prefix changes on disk, the checkpointed hash state cannot notice
+	ingestPath := filepath.Join(root, "ingest", d.Algorithm, d.Hex)
+	f, err := os.OpenFile(ingestPath, os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte{^data[0]}, 0); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	resumed := &controlledLayer{Layer: base, data: data, failAt: -1}
+	if _, err := s.AddOCI(ctx, newLayersArtifact(resumed), "large/blob:v1"); err == nil {
+		t.Fatal("expected verification of the tampered ingest to fail")
+	}
+	if _, err := os.Stat(filepath.Join(root, "blobs", d.Algorithm, d.Hex)); !os.IsNotExist(err) {
+		t.Fatalf("expected no blob after failed verification, got %v", err)
+	}
+
+	// the tampered ingest was discarded, so the next write starts over and succeeds
+	if _, err := s.AddOCI(ctx, newLayersArtifact(resumed), "large/blob:v1"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLayout_AddOCI_ConcurrentSameLayer(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	s, err := store.NewLayout(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 8<<20)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	lyr := static.NewLayer(data, types.OCIUncompressedLayer)
+
+	// the same layer repeated within an artifact, and shared between artifacts added concurrently
+	var g errgroup.Group
+	for i := 0; i < 4; i++ {
+		ref := fmt.Sprintf("repeated/layer:v%d", i)
+		g.Go(func() error {
+			_, err := s.AddOCI(ctx, newLayersArtifact(lyr, lyr, lyr), ref)
+			return err
+		})
+	}
+	if err := g.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Validate(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLayout_AddOCI_ConcurrentReaders(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	s, err := store.NewLayout(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// readers reload the index from disk while writers update it, run with -race to catch unsynchronized access
+	done := make(chan struct{})
+	var readers errgroup.Group
+	readers.Go(func() error {
+		for {
+			select {
+			case <-done:
+				return nil
+			default:
+			}
+			if err := s.Walk(func(reference string, desc ocispec.Descriptor) error { return nil }); err != nil {
+				return err
+			}
+			if _, _, err := s.Resolve(ctx, "concurrent/content:v0"); err != nil {
+				return err
+			}
+		}
+	})
+
+	var writers errgroup.Group
+	for i := 0; i < 64; i++ {
+		ref := fmt.Sprintf("concurrent/content:v%d", i)
+		data := []byte(ref)
+		writers.Go(func() error {
+			_, err := s.AddOCI(ctx, memory.NewMemory(data, "text/plain"), ref)
+			return err
+		})
+	}
+	werr := writers.Wait()
+	close(done)
+	if err := readers.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if werr != nil {
+		t.Fatal(werr)
+	}
+
+	if got := indexedRefs(t); len(got) != 64 {
+		t.Errorf("expected 64 indexed references, got %v", got)
+	}
+}
+
+// controlledLayer serves data as its compressed content, optionally failing after failAt bytes
+type controlledLayer struct {
+	v1.Layer
+
+	data     []byte
+	failAt   int
+	seekedTo int64
+}
+
+func (c *controlledLayer) Compressed() (io.ReadCloser, error) {
+	return &controlledReader{r: bytes.NewReader(c.data), layer: c}, nil
+}
+
+type controlledReader struct {
+	r     *bytes.Reader
+	layer *controlledLayer
+	read  int
+}
+
+func (r *controlledReader) Read(p []byte) (int, error) {
+	if r.layer.failAt >= 0 {
+		if r.read >= r.layer.failAt {
+			return 0, errors.New("connection reset")
+		}
+		if rem := r.layer.failAt - r.read; len(p) > rem {
+			p = p[:rem]
+		}
+	}
+	n, err := r.r.Read(p)
+	r.read += n
+	return n, err
+}
+
+func (r *controlledReader) Seek(offset int64, whence int) (int64, error) {
+	n, err := r.r.Seek(offset, whence)
+	r.layer.seekedTo = n
+	return n, err
+}
+
+func (r *controlledReader) Close() error {
+	return nil
+}
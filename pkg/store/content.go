@@ -0,0 +1,126 @@
+package store
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// OpenContent streams the uncompressed content of every layer of ref, in manifest order, as one continuous reader
+// 	For a single file artifact this is the file itself, for one split across several layers it is the reassembled
+// 	whole.  Layers are decompressed according to the +gzip or +zstd suffix of their media type.
+func (l *Layout) OpenContent(ctx context.Context, ref string) (io.ReadCloser, error) {
+	_, desc, err := l.OCI.Resolve(ctx, ref)
+	if err != nil {
+		return nil, fmt.Errorf("resolve %s: %w", ref, err)
+	}
+	if desc.Digest == "" {
+		return nil, fmt.Errorf("reference not found: %s", ref)
+	}
+	if !isManifest(desc.MediaType) {
+		return nil, fmt.Errorf("reference %s is not a manifest: %s", ref, desc.MediaType)
+	}
+
+	m, err := l.fetchManifest(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &layersReader{ctx: ctx, l: l, layers: m.Layers}, nil
+}
+
+// layersReader reads each of layers in turn, only opening a layer once the previous one is exhausted
+type layersReader struct {
+	ctx    context.Context
+	l      *Layout
+	layers []ocispec.Descriptor
+
+	cur io.ReadCloser
+}
+
+func (r *layersReader) Read(p []byte) (int, error) {
+	for {
+		if r.cur == nil {
+			if len(r.layers) == 0 {
+				return 0, io.EOF
+			}
+
+			rc, err := r.l.openLayer(r.ctx, r.layers[0])
+			if err != nil {
+				return 0, fmt.Errorf("open layer %s: %w", r.layers[0].Digest, err)
+			}
+			r.cur = rc
+			r.layers = r.layers[1:]
+		}
+
+		n, err := r.cur.Read(p)
+		if err == io.EOF {
+			if cerr := r.cur.Close(); cerr != nil {
+				return n, cerr
+			}
+			r.cur = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (r *layersReader) Close() error {
+	if r.cur == nil {
+		return nil
+	}
+	err := r.cur.Close()
+	r.cur = nil
+	return err
+}
+
+// openLayer opens the uncompressed content of a layer
+func (l *Layout) openLayer(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	rc, err := l.OCI.Fetch(ctx, desc)
+	if err != nil {
+		return nil, err
+	}
+
+	switch mt := desc.MediaType; {
+	case strings.HasSuffix(mt, "+gzip") || strings.HasSuffix(mt, ".gzip"):
+		zr, err := gzip.NewReader(rc)
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		return &readCloser{Reader: zr, closes: []func() error{zr.Close, rc.Close}}, nil
+
+	case strings.HasSuffix(mt, "+zstd"):
+		zr, err := zstd.NewReader(rc)
+		if err != nil {
+			rc.Close()
+			return nil, err
+		}
+		return &readCloser{Reader: zr, closes: []func() error{func() error { zr.Close(); return nil }, rc.Close}}, nil
+	}
+	return rc, nil
+}
+
+// readCloser reads from Reader and closes each of closes in order
+type readCloser struct {
+	io.Reader
+	closes []func() error
+}
+
+func (rc *readCloser) Close() error {
+	var err error
+	for _, c := range rc.closes {
+		if cerr := c(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
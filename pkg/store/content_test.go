@@ -0,0 +1,94 @@
+package store_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"math/rand"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	"github.com/rancherfederal/ocil/pkg/artifacts/memory"
+	"github.com/rancherfederal/ocil/pkg/consts"
+	"github.com/rancherfederal/ocil/pkg/store"
+)
+
+func TestLayout_OpenContent(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	s, err := store.NewLayout(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original := make([]byte, 3<<20)
+	if _, err := rand.Read(original); err != nil {
+		t.Fatal(err)
+	}
+
+	// split the file into parts, one of which is stored compressed
+	var parts []v1.Layer
+	for i, chunk := range [][]byte{original[:1<<20], original[1<<20 : 2<<20], original[2<<20:]} {
+		if i == 1 {
+			parts = append(parts, gzipLayer(t, chunk, gzip.BestSpeed))
+			continue
+		}
+		parts = append(parts, static.NewLayer(chunk, types.MediaType(consts.FileLayerMediaType)))
+	}
+
+	if _, err := s.AddOCI(ctx, newLayersArtifact(parts...), "split/file:v1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddOCI(ctx, memory.NewMemory([]byte("single"), "text/plain"), "single/file:v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		ref     string
+		want    []byte
+		wantErr bool
+	}{
+		{
+			name:    "should reassemble a split file",
+			ref:     "split/file:v1",
+			want:    original,
+			wantErr: false,
+		},
+		{
+			name:    "should yield a single file",
+			ref:     "single/file:v1",
+			want:    []byte("single"),
+			wantErr: false,
+		},
+		{
+			name:    "should fail for unknown references",
+			ref:     "missing/file:v1",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rc, err := s.OpenContent(ctx, tt.ref)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("OpenContent() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			defer rc.Close()
+
+			got, err := io.ReadAll(rc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("OpenContent() content does not match: got %d bytes, want %d bytes", len(got), len(tt.want))
+			}
+		})
+	}
+}
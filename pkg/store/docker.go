@@ -0,0 +1,71 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/rancherfederal/ocil/pkg/consts"
+)
+
+// ErrNotImage is returned when exporting a reference that is not a container image
+var ErrNotImage = errors.New("reference is not an image")
+
+// ExportDockerArchive writes refs to w as a Docker archive (a manifest.json alongside the config and layer blobs) that
+// can be loaded with `docker load`
+// 	Every ref must be a repo:tag reference to an image, that is a manifest with an OCI or Docker image config.  Any
+// 	other artifact fails the whole export with ErrNotImage, as a Docker archive has no way of representing it.
+func (l *Layout) ExportDockerArchive(ctx context.Context, refs []string, w io.Writer) error {
+	p, err := layout.FromPath(l.Root)
+	if err != nil {
+		return fmt.Errorf("layout: %w", err)
+	}
+
+	refToImage := make(map[name.Reference]v1.Image)
+	for _, ref := range refs {
+		_, desc, err := l.OCI.Resolve(ctx, ref)
+		if err != nil {
+			return fmt.Errorf("resolve %s: %w", ref, err)
+		}
+		if desc.Digest == "" {
+			return fmt.Errorf("reference not found: %s", ref)
+		}
+		if !isManifest(desc.MediaType) {
+			return fmt.Errorf("%s: %w", ref, ErrNotImage)
+		}
+
+		m, err := l.fetchManifest(ctx, desc)
+		if err != nil {
+			return err
+		}
+		switch m.Config.MediaType {
+		case ocispec.MediaTypeImageConfig, consts.DockerConfigJSON:
+		default:
+			return fmt.Errorf("%s: config %s: %w", ref, m.Config.MediaType, ErrNotImage)
+		}
+
+		tag, err := name.NewTag(ref)
+		if err != nil {
+			return fmt.Errorf("parse tag %s: %w", ref, err)
+		}
+
+		h, err := v1.NewHash(desc.Digest.String())
+		if err != nil {
+			return err
+		}
+		img, err := p.Image(h)
+		if err != nil {
+			return fmt.Errorf("image %s: %w", ref, err)
+		}
+		refToImage[tag] = img
+	}
+
+	return tarball.MultiRefWrite(refToImage, w)
+}
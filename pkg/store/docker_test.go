@@ -0,0 +1,96 @@
+package store_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/tarball"
+
+	"github.com/rancherfederal/ocil/pkg/artifacts/memory"
+	"github.com/rancherfederal/ocil/pkg/store"
+)
+
+func TestLayout_ExportDockerArchive(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	s, err := store.NewLayout(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, err := random.Image(1024, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddOCI(ctx, &mockArtifact{img}, "hello/world:v1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddOCI(ctx, memory.NewMemory([]byte("not an image"), "text/plain"), "hello/file:v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if err := s.ExportDockerArchive(ctx, []string{"hello/world:v1"}, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	tag, err := name.NewTag("hello/world:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	opener := func() (io.ReadCloser, error) {
+		return ioutil.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	}
+	loaded, err := tarball.Image(opener, &tag)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantCfg, err := img.ConfigName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotCfg, err := loaded.ConfigName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gotCfg != wantCfg {
+		t.Errorf("unexpected config: got %s, want %s", gotCfg, wantCfg)
+	}
+
+	wantLayers, err := img.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotLayers, err := loaded.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(gotLayers) != len(wantLayers) {
+		t.Fatalf("unexpected layer count: got %d, want %d", len(gotLayers), len(wantLayers))
+	}
+	for i := range wantLayers {
+		want, err := wantLayers[i].Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := gotLayers[i].Digest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("unexpected layer %d: got %s, want %s", i, got, want)
+		}
+	}
+
+	err = s.ExportDockerArchive(ctx, []string{"hello/world:v1", "hello/file:v1"}, ioutil.Discard)
+	if !errors.Is(err, store.ErrNotImage) {
+		t.Errorf("expected ErrNotImage exporting a non-image artifact, got %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package store
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// GC removes every blob not reachable from the index and returns the digests of those removed
+// 	Reachable blobs are verified, and any that are corrupt are handled according to the store's CorruptPolicy.  By
+// 	default they are reported but never deleted.  Reachable blobs that are missing are reported too.  Blobs held by an
+// 	open transaction or a write in progress are never removed, and partial writes nothing holds are removed from
+// 	ingest.  If any reachable manifest cannot be decoded, nothing is removed.
+func (l *Layout) GC(ctx context.Context) ([]digest.Digest, error) {
+	// pin before reading the index, so anything indexed after it has been read is still protected
+	defer l.collecting()()
+
+	referenced, err := l.referencedBlobs(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("referenced blobs: %w", err)
+	}
+
+	var (
+		removed []digest.Digest
+		errs    blobErrors
+	)
+	present := make(map[digest.Digest]bool)
+	err = l.walkBlobs(func(path string, d digest.Digest, fi fs.FileInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		present[d] = true
+
+		if _, ok := referenced[d]; !ok {
+			ok, err := l.holds.unlessPinned(d, func() error { return os.Remove(path) })
+			if err != nil {
+				return err
+			}
+			if ok {
+				removed = append(removed, d)
+			}
+			return nil
+		}
+
+		if err := l.verifyBlob(path, d, fi); err != nil {
+			errs = append(errs, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return removed, fmt.Errorf("walk blobs: %w", err)
+	}
+	errs = append(errs, missingBlobs(referenced, present)...)
+
+	if err := l.gcIngest(); err != nil {
+		return removed, fmt.Errorf("ingest: %w", err)
+	}
+
+	if errs != nil {
+		return removed, errs
+	}
+	return removed, nil
+}
+
+// collecting serializes GC and validation, pinning every held blob until the returned function is called
+func (l *Layout) collecting() func() {
+	l.gc.Lock()
+	l.holds.pin()
+	return func() {
+		l.holds.unpin()
+		l.gc.Unlock()
+	}
+}
+
+// gcIngest removes every partial write, and its checkpoint, that no write or transaction holds
+func (l *Layout) gcIngest() error {
+	ingest := filepath.Join(l.Root, "ingest")
+	return filepath.WalkDir(ingest, func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if de.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(ingest, path)
+		if err != nil {
+			return err
+		}
+		rel = strings.TrimSuffix(strings.TrimSuffix(rel, ".tmp"), ".checkpoint")
+		d := digest.Digest(strings.Replace(filepath.ToSlash(rel), "/", ":", 1))
+
+		_, err = l.holds.unlessPinned(d, func() error { return os.RemoveAll(path) })
+		return err
+	})
+}
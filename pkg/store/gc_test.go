@@ -0,0 +1,410 @@
+package store_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/rancherfederal/ocil/pkg/artifacts/memory"
+	"github.com/rancherfederal/ocil/pkg/store"
+)
+
+func TestLayout_GC(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	s, err := store.NewLayout(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	live := memory.NewMemory([]byte("live"), "text/plain")
+	if _, err := s.AddOCI(ctx, live, "gc/live:v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	orphan := []byte("orphan")
+	od := digest.FromBytes(orphan)
+	orphanPath := filepath.Join(root, "blobs", od.Algorithm().String(), od.Hex())
+	if err := os.WriteFile(orphanPath, orphan, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := s.GC(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 1 || removed[0] != od {
+		t.Errorf("unexpected removed blobs: got %v, want [%s]", removed, od)
+	}
+	if _, err := os.Stat(orphanPath); !os.IsNotExist(err) {
+		t.Errorf("expected orphan blob to be removed, got %v", err)
+	}
+	if _, err := os.Stat(memoryBlobPath(t, live)); err != nil {
+		t.Errorf("expected live blob to be kept: %v", err)
+	}
+}
+
+func TestLayout_WithCorruptPolicy(t *testing.T) {
+	tests := []struct {
+		name           string
+		policy         store.CorruptPolicy
+		wantErr        error
+		wantInBlobs    bool
+		wantQuarantine bool
+	}{
+		{
+			name:        "should report and keep by default",
+			policy:      store.CorruptPolicyReport,
+			wantErr:     store.ErrCorruptBlob,
+			wantInBlobs: true,
+		},
+		{
+			name:        "should silently keep as present",
+			policy:      store.CorruptPolicyKeep,
+			wantErr:     nil,
+			wantInBlobs: true,
+		},
+		{
+			name:        "should remove and flag as missing",
+			policy:      store.CorruptPolicyMissing,
+			wantErr:     store.ErrMissingBlob,
+			wantInBlobs: false,
+		},
+		{
+			name:           "should move to quarantine",
+			policy:         store.CorruptPolicyQuarantine,
+			wantErr:        store.ErrCorruptBlob,
+			wantInBlobs:    false,
+			wantQuarantine: true,
+		},
+	}
+	ops := map[string]func(s *store.Layout) error{
+		"GC": func(s *store.Layout) error {
+			_, err := s.GC(ctx)
+			return err
+		},
+		"Validate": func(s *store.Layout) error {
+			return s.Validate(ctx)
+		},
+	}
+	for _, tt := range tests {
+		for op, fn := range ops {
+			t.Run(op+" "+tt.name, func(t *testing.T) {
+				teardown := setup(t)
+				defer teardown()
+
+				s, err := store.NewLayout(root, store.WithCorruptPolicy(tt.policy))
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				live := memory.NewMemory([]byte("live"), "text/plain")
+				if _, err := s.AddOCI(ctx, live, "corrupt/live:v1"); err != nil {
+					t.Fatal(err)
+				}
+				blobPath := memoryBlobPath(t, live)
+				if err := os.WriteFile(blobPath, []byte("corrupted"), 0644); err != nil {
+					t.Fatal(err)
+				}
+
+				err = fn(s)
+				switch {
+				case tt.wantErr == nil && err != nil:
+					t.Errorf("unexpected error: %v", err)
+				case tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+					t.Errorf("expected error matching %q, got %v", tt.wantErr, err)
+				}
+
+				_, err = os.Stat(blobPath)
+				if inBlobs := err == nil; inBlobs != tt.wantInBlobs {
+					t.Errorf("unexpected blob presence: got %v, want %v", inBlobs, tt.wantInBlobs)
+				}
+
+				rel, err := filepath.Rel(filepath.Join(root, "blobs"), blobPath)
+				if err != nil {
+					t.Fatal(err)
+				}
+				_, err = os.Stat(filepath.Join(root, "quarantine", rel))
+				if quarantined := err == nil; quarantined != tt.wantQuarantine {
+					t.Errorf("unexpected quarantine presence: got %v, want %v", quarantined, tt.wantQuarantine)
+				}
+
+				// a blob flagged as missing is re-fetched the next time its content is added
+				if tt.policy == store.CorruptPolicyMissing {
+					if _, err := s.AddOCI(ctx, live, "corrupt/live:v1"); err != nil {
+						t.Fatal(err)
+					}
+					if err := s.Validate(ctx); err != nil {
+						t.Errorf("expected re-fetched blob to validate, got %v", err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func TestLayout_GC_UnrecognisedManifests(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	s, err := store.NewLayout(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	live := memory.NewMemory([]byte("live"), "text/plain")
+	desc, err := s.AddOCI(ctx, live, "gc/untyped:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// an index entry without a media type still refers to its config and layers
+	desc.MediaType = ""
+	if err := s.AddIndex(desc); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := s.GC(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 0 {
+		t.Errorf("expected nothing to be removed, got %v", removed)
+	}
+	if err := s.Validate(ctx); err != nil {
+		t.Errorf("expected every blob to be kept, got %v", err)
+	}
+
+	// an index entry that is neither a manifest nor an index stops anything from being collected
+	opaque := []byte("opaque")
+	od := digest.FromBytes(opaque)
+	if err := os.WriteFile(filepath.Join(root, "blobs", od.Algorithm().String(), od.Hex()), opaque, 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = s.AddIndex(ocispec.Descriptor{
+		MediaType:   "application/vnd.unknown",
+		Digest:      od,
+		Size:        int64(len(opaque)),
+		Annotations: map[string]string{ocispec.AnnotationRefName: "gc/opaque:v1"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	orphan := []byte("orphan")
+	orphanPath := filepath.Join(root, "blobs", "sha256", digest.FromBytes(orphan).Hex())
+	if err := os.WriteFile(orphanPath, orphan, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err = s.GC(ctx)
+	if err == nil {
+		t.Fatal("expected GC to refuse an undecodable manifest")
+	}
+	if len(removed) != 0 {
+		t.Errorf("expected nothing to be removed, got %v", removed)
+	}
+	if _, err := os.Stat(orphanPath); err != nil {
+		t.Errorf("expected orphan blob to be kept: %v", err)
+	}
+}
+
+func TestLayout_GC_KeepsStagedBlobs(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	s, err := store.NewLayout(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	staged := memory.NewMemory([]byte("staged"), "text/plain")
+	tx := s.Begin()
+	if _, err := tx.AddOCI(ctx, staged, "gc/staged:v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := s.GC(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(removed) != 0 {
+		t.Errorf("expected staged blobs to be kept, got %v removed", removed)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Validate(ctx); err != nil {
+		t.Errorf("expected committed reference to be complete, got %v", err)
+	}
+}
+
+func TestLayout_GC_MissingBlobs(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	s, err := store.NewLayout(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	live := memory.NewMemory([]byte("live"), "text/plain")
+	if _, err := s.AddOCI(ctx, live, "gc/missing:v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(memoryBlobPath(t, live)); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.GC(ctx); !errors.Is(err, store.ErrMissingBlob) {
+		t.Errorf("expected GC to report the missing blob, got %v", err)
+	}
+	if err := s.Validate(ctx); !errors.Is(err, store.ErrMissingBlob) {
+		t.Errorf("expected Validate to report the missing blob, got %v", err)
+	}
+}
+
+func TestLayout_GC_Ingest(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	s, err := store.NewLayout(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// an abandoned partial write and its checkpoint
+	d := digest.FromBytes([]byte("abandoned"))
+	dir := filepath.Join(root, "ingest", d.Algorithm().String())
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{d.Hex(), d.Hex() + ".checkpoint"} {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte("aban"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := s.GC(ctx); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{d.Hex(), d.Hex() + ".checkpoint"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, got %v", name, err)
+		}
+	}
+}
+
+func TestLayout_GC_ConcurrentAddOCI(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	s, err := store.NewLayout(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// collections run while writers add content, run with -race to catch unsynchronized access
+	done := make(chan struct{})
+	var collector errgroup.Group
+	collector.Go(func() error {
+		for {
+			select {
+			case <-done:
+				return nil
+			default:
+			}
+			if _, err := s.GC(ctx); err != nil {
+				return err
+			}
+		}
+	})
+
+	var writers errgroup.Group
+	for i := 0; i < 64; i++ {
+		ref := fmt.Sprintf("gc/concurrent:v%d", i)
+		data := []byte(ref)
+		writers.Go(func() error {
+			_, err := s.AddOCI(ctx, memory.NewMemory(data, "text/plain"), ref)
+			return err
+		})
+	}
+	werr := writers.Wait()
+	close(done)
+	if err := collector.Wait(); err != nil {
+		t.Fatal(err)
+	}
+	if werr != nil {
+		t.Fatal(werr)
+	}
+
+	// nothing a writer added was collected out from under it
+	if got := indexedRefs(t); len(got) != 64 {
+		t.Errorf("expected 64 indexed references, got %v", got)
+	}
+	if err := s.Validate(ctx); err != nil {
+		t.Errorf("expected every reference to be complete, got %v", err)
+	}
+}
+
+func TestLayout_WithCorruptPolicy_KeepsHeldBlobs(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	s, err := store.NewLayout(root, store.WithCorruptPolicy(store.CorruptPolicyMissing))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	live := memory.NewMemory([]byte("live"), "text/plain")
+	if _, err := s.AddOCI(ctx, live, "corrupt/held:v1"); err != nil {
+		t.Fatal(err)
+	}
+	blobPath := memoryBlobPath(t, live)
+	if err := os.WriteFile(blobPath, []byte("corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// an open transaction depends on the corrupt blob, so it is only reported
+	tx := s.Begin()
+	if _, err := tx.AddOCI(ctx, live, "corrupt/staged:v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	ops := map[string]func() error{
+		"GC": func() error {
+			_, err := s.GC(ctx)
+			return err
+		},
+		"Validate": func() error {
+			return s.Validate(ctx)
+		},
+		"ValidateSince": func() error {
+			return s.ValidateSince(ctx, time.Time{})
+		},
+	}
+	for op, fn := range ops {
+		err := fn()
+		if !errors.Is(err, store.ErrCorruptBlob) || errors.Is(err, store.ErrMissingBlob) {
+			t.Errorf("%s: expected the held blob to be reported as corrupt only, got %v", op, err)
+		}
+		if _, err := os.Stat(blobPath); err != nil {
+			t.Errorf("%s: expected the held blob to be kept: %v", op, err)
+		}
+	}
+
+	if err := tx.Rollback(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Validate(ctx); !errors.Is(err, store.ErrMissingBlob) {
+		t.Errorf("expected the released blob to be removed as missing, got %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package store
+
+import (
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+)
+
+// holds counts the writes and open transactions that depend on each blob
+// 	A blob that is held may not be indexed yet, so nothing removes it until every holder releases it.
+type holds struct {
+	mu     sync.Mutex
+	counts map[digest.Digest]int
+
+	// pinned is every blob held since pin was called, it is nil unless a GC is running
+	pinned map[digest.Digest]bool
+}
+
+// acquire holds each of ds, it must be called before the blob is written or found to already exist
+func (h *holds) acquire(ds ...digest.Digest) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.counts == nil {
+		h.counts = make(map[digest.Digest]int)
+	}
+	for _, d := range ds {
+		h.counts[d]++
+		if h.pinned != nil {
+			h.pinned[d] = true
+		}
+	}
+}
+
+// release gives up one hold on each of ds
+func (h *holds) release(ds ...digest.Digest) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, d := range ds {
+		if h.counts[d]--; h.counts[d] <= 0 {
+			delete(h.counts, d)
+		}
+	}
+}
+
+// locked runs fn while no hold can be acquired or released, held reports whether a blob is held by anyone
+func (h *holds) locked(fn func(held func(digest.Digest) bool) error) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return fn(func(d digest.Digest) bool { return h.counts[d] > 0 })
+}
+
+// pin starts recording every blob held from now on, including those held already, until unpin is called
+// 	A blob that is released during a GC may have just been indexed after the GC read the index, so it stays protected
+// 	for the rest of the run.
+func (h *holds) pin() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pinned = make(map[digest.Digest]bool, len(h.counts))
+	for d := range h.counts {
+		h.pinned[d] = true
+	}
+}
+
+func (h *holds) unpin() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pinned = nil
+}
+
+// unlessPinned runs fn while no hold can be acquired, unless d has been held since pin was called
+func (h *holds) unlessPinned(d digest.Digest, fn func() error) (bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.pinned[d] || h.counts[d] > 0 {
+		return false, nil
+	}
+	return true, fn()
+}
@@ -0,0 +1,204 @@
+package store
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	// DefaultRepackThreshold is the minimum estimated fraction of bytes saved before a layer is suggested for repacking
+	DefaultRepackThreshold = 0.1
+
+	// repackSampleSize is the number of uncompressed bytes of each layer used to estimate savings
+	repackSampleSize = 1 << 20
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// WithRepackThreshold sets the minimum estimated savings (as a fraction of the current size) RepackAdvisor requires
+// before suggesting a layer
+// 	A threshold of 0 suggests every layer estimated to shrink at all
+func WithRepackThreshold(threshold float64) Options {
+	return func(l *Layout) {
+		l.repackThreshold = &threshold
+	}
+}
+
+// RepackSuggestion describes a reference that is estimated to shrink if its layers were recompressed with zstd
+type RepackSuggestion struct {
+	// Reference is the name of the reference within the store
+	Reference string
+
+	// Layers are the digests of the layers whose estimated savings meet the threshold
+	Layers []digest.Digest
+
+	// CurrentSize is the combined size of all the reference's layers as they are currently stored
+	CurrentSize int64
+
+	// EstimatedSize is the estimated combined size of the reference's layers after repacking Layers with zstd
+	EstimatedSize int64
+}
+
+// Savings returns the estimated fraction of CurrentSize that repacking would save
+func (s RepackSuggestion) Savings() float64 {
+	if s.CurrentSize == 0 {
+		return 0
+	}
+	return 1 - float64(s.EstimatedSize)/float64(s.CurrentSize)
+}
+
+// RepackAdvisor samples the layers of every reference in the store and suggests the references that would shrink by
+// at least the configured threshold if their layers were recompressed with zstd
+// 	This is purely advisory, nothing in the store is modified.  Layers already compressed with zstd are never suggested.
+func (l *Layout) RepackAdvisor(ctx context.Context) ([]RepackSuggestion, error) {
+	threshold := DefaultRepackThreshold
+	if l.repackThreshold != nil {
+		threshold = *l.repackThreshold
+	}
+
+	// the same layer is commonly shared between references, only sample it once
+	estimates := make(map[digest.Digest]int64)
+
+	var suggestions []RepackSuggestion
+	err := l.OCI.Walk(func(reference string, desc ocispec.Descriptor) error {
+		if !isManifest(desc.MediaType) {
+			return nil
+		}
+
+		m, err := l.fetchManifest(ctx, desc)
+		if err != nil {
+			return err
+		}
+
+		s := RepackSuggestion{Reference: reference}
+		for _, lyr := range m.Layers {
+			est, ok := estimates[lyr.Digest]
+			if !ok {
+				est, err = l.estimateZstdSize(ctx, lyr)
+				if err != nil {
+					return fmt.Errorf("estimate %s: %w", lyr.Digest, err)
+				}
+				estimates[lyr.Digest] = est
+			}
+
+			s.CurrentSize += lyr.Size
+			if savings := 1 - float64(est)/float64(lyr.Size); lyr.Size > 0 && savings > 0 && savings >= threshold {
+				s.Layers = append(s.Layers, lyr.Digest)
+				s.EstimatedSize += est
+			} else {
+				s.EstimatedSize += lyr.Size
+			}
+		}
+
+		if len(s.Layers) > 0 {
+			suggestions = append(suggestions, s)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walk: %w", err)
+	}
+
+	sort.Slice(suggestions, func(i, j int) bool {
+		return suggestions[i].Reference < suggestions[j].Reference
+	})
+	return suggestions, nil
+}
+
+// estimateZstdSize estimates the size of desc's blob if it were recompressed with zstd
+// 	Only the leading repackSampleSize uncompressed bytes are recompressed, the ratio between the stored bytes consumed
+// 	and the zstd output for that sample is then extrapolated to the whole blob.
+func (l *Layout) estimateZstdSize(ctx context.Context, desc ocispec.Descriptor) (int64, error) {
+	rc, err := l.OCI.Fetch(ctx, desc)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	cr := &countingReader{r: bufio.NewReader(rc)}
+	magic, err := cr.r.Peek(len(zstdMagic))
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+
+	var src io.Reader = cr
+	switch {
+	case bytes.HasPrefix(magic, zstdMagic):
+		return desc.Size, nil
+
+	case bytes.HasPrefix(magic, gzipMagic):
+		zr, err := gzip.NewReader(cr)
+		if err != nil {
+			return 0, err
+		}
+		defer zr.Close()
+		src = zr
+	}
+
+	out := &countingWriter{w: ioutil.Discard}
+	enc, err := zstd.NewWriter(out, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := io.CopyN(enc, src, repackSampleSize)
+	if err != nil && err != io.EOF {
+		enc.Close()
+		return 0, err
+	}
+	if err := enc.Close(); err != nil {
+		return 0, err
+	}
+
+	if n == 0 || cr.n == 0 {
+		return desc.Size, nil
+	}
+	return int64(float64(desc.Size) * float64(out.n) / float64(cr.n)), nil
+}
+
+// countingReader counts the bytes read through it
+// 	It implements io.ByteReader so decompressors consume from it directly rather than through their own read-ahead
+// 	buffers, keeping the count accurate.
+type countingReader struct {
+	r *bufio.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.n++
+	}
+	return b, err
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,107 @@
+package store_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"math/rand"
+	"testing"
+
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+
+	"github.com/rancherfederal/ocil/pkg/store"
+)
+
+func TestLayout_RepackAdvisor(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	s, err := store.NewLayout(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// stored (level 0) gzip of highly repetitive content leaves plenty on the table
+	compressible := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 1<<14)
+	loose := gzipLayer(t, compressible, gzip.NoCompression)
+
+	// random content is already as small as it will get
+	random := make([]byte, 1<<18)
+	if _, err := rand.Read(random); err != nil {
+		t.Fatal(err)
+	}
+	optimal := gzipLayer(t, random, gzip.BestCompression)
+
+	if _, err := s.AddOCI(ctx, newLayersArtifact(loose), "repack/compressible:v1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddOCI(ctx, newLayersArtifact(optimal), "repack/optimal:v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.RepackAdvisor(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got) != 1 {
+		t.Fatalf("expected 1 suggestion, got %d: %+v", len(got), got)
+	}
+	if got[0].Reference != "repack/compressible:v1" {
+		t.Errorf("unexpected suggestion: got %s, want %s", got[0].Reference, "repack/compressible:v1")
+	}
+
+	d, err := loose.Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got[0].Layers) != 1 || got[0].Layers[0].String() != d.String() {
+		t.Errorf("unexpected suggested layers: got %v, want [%s]", got[0].Layers, d)
+	}
+	if got[0].Savings() < store.DefaultRepackThreshold {
+		t.Errorf("suggested savings %f below threshold %f", got[0].Savings(), store.DefaultRepackThreshold)
+	}
+}
+
+func TestLayout_RepackAdvisor_ZeroThreshold(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	s, err := store.NewLayout(root, store.WithRepackThreshold(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// any estimated saving at all is enough to be suggested
+	compressible := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog\n"), 1<<14)
+	if _, err := s.AddOCI(ctx, newLayersArtifact(gzipLayer(t, compressible, gzip.BestSpeed)), "repack/fast:v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := s.RepackAdvisor(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Reference != "repack/fast:v1" {
+		t.Fatalf("expected a zero threshold to suggest repack/fast:v1, got %+v", got)
+	}
+	if got[0].Savings() <= 0 {
+		t.Errorf("expected positive savings, got %f", got[0].Savings())
+	}
+}
+
+func gzipLayer(t *testing.T, data []byte, level int) v1.Layer {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := zw.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return static.NewLayer(buf.Bytes(), types.OCILayer)
+}
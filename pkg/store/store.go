@@ -7,6 +7,8 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/static"
@@ -17,6 +19,7 @@ import (
 	"oras.land/oras-go/pkg/target"
 
 	"github.com/rancherfederal/ocil/pkg/artifacts"
+	"github.com/rancherfederal/ocil/pkg/consts"
 	"github.com/rancherfederal/ocil/pkg/content"
 	"github.com/rancherfederal/ocil/pkg/layer"
 )
@@ -25,6 +28,19 @@ type Layout struct {
 	*content.OCI
 	Root  string
 	cache layer.Cache
+
+	repackThreshold    *float64
+	checkpointInterval int64
+	corruptPolicy      CorruptPolicy
+
+	// writes serializes concurrent writers of the same blob
+	writes keyedMutex
+
+	// holds protects blobs that are written but not yet indexed from removal
+	holds holds
+
+	// gc serializes garbage collections
+	gc sync.Mutex
 }
 
 type Options func(*Layout)
@@ -63,52 +79,106 @@ func NewLayout(rootdir string, opts ...Options) (*Layout, error) {
 //  strict types to define generic content, but provides a processing pipeline suitable for extensibility.  In the
 //  future we'll allow users to define their own content that must adhere either by artifact.OCI or simply an OCI layout.
 func (l *Layout) AddOCI(ctx context.Context, oci artifacts.OCI, ref string) (ocispec.Descriptor, error) {
+	idx, held, _, err := l.writeOCI(ctx, oci, ref)
+	defer l.holds.release(held...)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+
+	err = l.OCI.AddIndex(idx)
+	if err != nil {
+		return ocispec.Descriptor{}, fmt.Errorf("add index: %w", err)
+	}
+
+	return idx, nil
+}
+
+// writeOCI writes all of an artifacts.OCI's blobs to the store without indexing it
+// 	The returned descriptor is suitable for indexing as ref.  Every blob the artifact depends on is held, even if
+// 	writing it failed, and the caller must release the returned held digests once it is indexed or abandoned.  The
+// 	returned written digests are the blobs that did not already exist in the store.
+func (l *Layout) writeOCI(ctx context.Context, oci artifacts.OCI, ref string) (ocispec.Descriptor, []digest.Digest, []digest.Digest, error) {
 	if l.cache != nil {
 		cached := layer.OCICache(oci, l.cache)
 		oci = cached
 	}
 
+	var (
+		mu      sync.Mutex
+		held    []digest.Digest
+		written []digest.Digest
+	)
+	hold := func(d digest.Digest) {
+		l.holds.acquire(d)
+		held = append(held, d)
+	}
+	record := func(d digest.Digest, ok bool) {
+		if ok {
+			mu.Lock()
+			defer mu.Unlock()
+			written = append(written, d)
+		}
+	}
+
 	// Write manifest blob
 	m, err := oci.Manifest()
 	if err != nil {
-		return ocispec.Descriptor{}, fmt.Errorf("manifest: %w", err)
+		return ocispec.Descriptor{}, held, written, fmt.Errorf("manifest: %w", err)
 	}
 
 	mdata, err := json.Marshal(m)
 	if err != nil {
-		return ocispec.Descriptor{}, fmt.Errorf("marshal manifest: %w", err)
+		return ocispec.Descriptor{}, held, written, fmt.Errorf("marshal manifest: %w", err)
 	}
-	if err := l.writeBlobData(mdata); err != nil {
-		return ocispec.Descriptor{}, fmt.Errorf("write blob data %w", err)
+	hold(digest.FromBytes(mdata))
+	ok, err := l.writeBlobData(mdata)
+	if err != nil {
+		return ocispec.Descriptor{}, held, written, fmt.Errorf("write blob data %w", err)
 	}
+	record(digest.FromBytes(mdata), ok)
 
 	// Write config blob
 	cdata, err := oci.RawConfig()
 	if err != nil {
-		return ocispec.Descriptor{}, fmt.Errorf("raw config: %w", err)
+		return ocispec.Descriptor{}, held, written, fmt.Errorf("raw config: %w", err)
 	}
 
-	static.NewLayer(cdata, "")
-
-	if err := l.writeBlobData(cdata); err != nil {
-		return ocispec.Descriptor{}, fmt.Errorf("write blob data: %w", err)
+	hold(digest.FromBytes(cdata))
+	ok, err = l.writeBlobData(cdata)
+	if err != nil {
+		return ocispec.Descriptor{}, held, written, fmt.Errorf("write blob data: %w", err)
 	}
+	record(digest.FromBytes(cdata), ok)
 
 	// write blob layers concurrently
 	layers, err := oci.Layers()
 	if err != nil {
-		return ocispec.Descriptor{}, fmt.Errorf("layers: %w", err)
+		return ocispec.Descriptor{}, held, written, fmt.Errorf("layers: %w", err)
 	}
 
+	// the same layer may legally appear several times, only write it once
 	var g errgroup.Group
+	unique := make(map[v1.Hash]bool)
 	for _, lyr := range layers {
 		lyr := lyr
+		d, err := lyr.Digest()
+		if err != nil {
+			return ocispec.Descriptor{}, held, written, fmt.Errorf("layer digest: %w", err)
+		}
+		if unique[d] {
+			continue
+		}
+		unique[d] = true
+		hold(digest.Digest(d.String()))
+
 		g.Go(func() error {
-			return l.writeLayer(lyr)
+			ok, err := l.writeLayer(lyr)
+			record(digest.Digest(d.String()), ok)
+			return err
 		})
 	}
 	if err := g.Wait(); err != nil {
-		return ocispec.Descriptor{}, fmt.Errorf("write layers: %w", err)
+		return ocispec.Descriptor{}, held, written, fmt.Errorf("write layers: %w", err)
 	}
 
 	// Build index
@@ -122,12 +192,7 @@ func (l *Layout) AddOCI(ctx context.Context, oci artifacts.OCI, ref string) (oci
 		URLs:     nil,
 		Platform: nil,
 	}
-	err = l.OCI.AddIndex(idx)
-	if err != nil {
-		return ocispec.Descriptor{}, fmt.Errorf("add index: %w", err)
-	}
-
-	return idx, nil
+	return idx, held, written, nil
 }
 
 // AddOCICollection .
@@ -162,6 +227,11 @@ func (l *Layout) Flush(ctx context.Context) error {
 		return err
 	}
 
+	ingest := filepath.Join(l.Root, "ingest")
+	if err := os.RemoveAll(ingest); err != nil {
+		return err
+	}
+
 	layout := filepath.Join(l.Root, "oci-layout")
 	if err := os.RemoveAll(layout); err != nil {
 		return err
@@ -187,21 +257,64 @@ func (l *Layout) Copy(ctx context.Context, ref string, to target.Target, toRef s
 	return desc, nil
 }
 
+// Router chooses the target.Target and destination ref a reference is copied to
+// 	totalSize is the combined size of every unique blob the reference is made of.  A nil target.Target copies to the
+// 	target given to CopyAll, which is an error if that is nil too, and an empty ref copies to the same ref as the source.
+type Router func(ref string, desc ocispec.Descriptor, totalSize int64) (target.Target, string, error)
+
+type CopyOption func(*copyOptions)
+
+type copyOptions struct {
+	router Router
+}
+
+// WithRouter routes each reference copied by CopyAll according to r
+func WithRouter(r Router) CopyOption {
+	return func(o *copyOptions) {
+		o.router = r
+	}
+}
+
 // CopyAll performs bulk copy operations on the stores oci layout to a provided target.Target
-func (l *Layout) CopyAll(ctx context.Context, to target.Target, toMapper func(string) (string, error)) ([]ocispec.Descriptor, error) {
+// 	When WithRouter is given, the router chooses each reference's target and destination ref in place of to and toMapper
+func (l *Layout) CopyAll(ctx context.Context, to target.Target, toMapper func(string) (string, error), opts ...CopyOption) ([]ocispec.Descriptor, error) {
+	o := &copyOptions{}
+	for _, opt := range opts {
+		opt(o)
+	}
+
 	var descs []ocispec.Descriptor
 	fmt.Println("THIS IS USING THE FORKED OCIL")
 	err := l.OCI.Walk(func(reference string, desc ocispec.Descriptor) error {
+		dst := to
 		toRef := ""
-		if toMapper != nil {
+		if o.router != nil {
+			size, err := l.contentSize(ctx, desc)
+			if err != nil {
+				return fmt.Errorf("size %s: %w", reference, err)
+			}
+
+			t, tr, err := o.router(reference, desc, size)
+			if err != nil {
+				return fmt.Errorf("router: %w", err)
+			}
+			if t != nil {
+				dst = t
+			}
+			toRef = tr
+
+		} else if toMapper != nil {
 			tr, err := toMapper(reference)
 			if err != nil {
 				return fmt.Errorf("mapper: %w", err)
 			}
 			toRef = tr
 		}
+		if dst == nil {
+			return fmt.Errorf("no target to copy %s to", reference)
+		}
 
-		desc, err := l.Copy(ctx, reference, to, toRef)
+		desc, err := l.Copy(ctx, reference, dst, toRef)
 		if err != nil {
 			return fmt.Errorf("layout copy: %w", err)
 		}
@@ -215,6 +328,22 @@ func (l *Layout) CopyAll(ctx context.Context, to target.Target, toMapper func(st
 	return descs, nil
 }
 
+// OpenIndex opens the raw index.json of the store and returns it along with its size
+// 	The bytes are exactly as they are on disk, avoiding the formatting (and digest) changes of a parse and re-marshal
+func (l *Layout) OpenIndex(ctx context.Context) (io.ReadCloser, int64, error) {
+	f, err := os.Open(filepath.Join(l.Root, consts.OCIImageIndexFile))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, fi.Size(), nil
+}
+
 // Identify is a helper function that will identify a human-readable content type given a descriptor
 func (l *Layout) Identify(ctx context.Context, desc ocispec.Descriptor) string {
 	rc, err := l.OCI.Fetch(ctx, desc)
@@ -235,39 +364,189 @@ func (l *Layout) Identify(ctx context.Context, desc ocispec.Descriptor) string {
 	return m.Config.MediaType
 }
 
-func (l *Layout) writeBlobData(data []byte) error {
-	blob := static.NewLayer(data, "") // NOTE: MediaType isn't actually used in the writing
-	return l.writeLayer(blob)
+// ReferencesWithMediaType returns the sorted references whose manifest config or any of its layers use mediaType
+func (l *Layout) ReferencesWithMediaType(ctx context.Context, mediaType string) ([]string, error) {
+	var refs []string
+	err := l.OCI.Walk(func(reference string, desc ocispec.Descriptor) error {
+		if !isManifest(desc.MediaType) {
+			return nil
+		}
+
+		m, err := l.fetchManifest(ctx, desc)
+		if err != nil {
+			return err
+		}
+
+		if m.Config.MediaType == mediaType {
+			refs = append(refs, reference)
+			return nil
+		}
+		for _, lyr := range m.Layers {
+			if lyr.MediaType == mediaType {
+				refs = append(refs, reference)
+				return nil
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walk: %w", err)
+	}
+
+	sort.Strings(refs)
+	return refs, nil
 }
 
-func (l *Layout) writeLayer(layer v1.Layer) error {
-	d, err := layer.Digest()
+// fetchManifest fetches and decodes the manifest identified by desc
+func (l *Layout) fetchManifest(ctx context.Context, desc ocispec.Descriptor) (*ocispec.Manifest, error) {
+	rc, err := l.OCI.Fetch(ctx, desc)
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer rc.Close()
 
-	r, err := layer.Compressed()
+	var m ocispec.Manifest
+	if err := json.NewDecoder(rc).Decode(&m); err != nil {
+		return nil, fmt.Errorf("decode manifest %s: %w", desc.Digest, err)
+	}
+	return &m, nil
+}
+
+// referencedBlobs returns the size of every blob reachable from the index, keyed by digest
+func (l *Layout) referencedBlobs(ctx context.Context) (map[digest.Digest]int64, error) {
+	refs := make(map[digest.Digest]int64)
+	err := l.OCI.Walk(func(reference string, desc ocispec.Descriptor) error {
+		return l.reachableBlobs(ctx, desc, refs)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("walk: %w", err)
+	}
+	return refs, nil
+}
+
+// contentSize returns the combined size of every unique blob reachable from desc
+func (l *Layout) contentSize(ctx context.Context, desc ocispec.Descriptor) (int64, error) {
+	blobs := make(map[digest.Digest]int64)
+	if err := l.reachableBlobs(ctx, desc, blobs); err != nil {
+		return 0, err
+	}
+
+	var total int64
+	for _, size := range blobs {
+		total += size
+	}
+	return total, nil
+}
+
+// reachableBlobs records the size of desc and every blob it refers to, recursively, into seen
+// 	Every descriptor is decoded as a manifest or an index whatever its media type claims, and one that is neither is
+// 	an error rather than a leaf, so nothing it refers to is ever mistaken for unreferenced.
+func (l *Layout) reachableBlobs(ctx context.Context, desc ocispec.Descriptor, seen map[digest.Digest]int64) error {
+	if _, ok := seen[desc.Digest]; ok {
+		return nil
+	}
+	seen[desc.Digest] = desc.Size
+
+	rc, err := l.OCI.Fetch(ctx, desc)
 	if err != nil {
 		return err
 	}
+	defer rc.Close()
+
+	var m manifestOrIndex
+	if err := json.NewDecoder(rc).Decode(&m); err != nil {
+		return fmt.Errorf("decode %s (%s): %w", desc.Digest, desc.MediaType, err)
+	}
+	if m.Config == nil && m.Layers == nil && m.Blobs == nil && m.Manifests == nil {
+		return fmt.Errorf("%s (%s) is neither a manifest nor an index", desc.Digest, desc.MediaType)
+	}
+
+	if m.Config != nil {
+		seen[m.Config.Digest] = m.Config.Size
+	}
+	for _, lyr := range append(m.Layers, m.Blobs...) {
+		seen[lyr.Digest] = lyr.Size
+	}
+	for _, child := range m.Manifests {
+		if err := l.reachableBlobs(ctx, child, seen); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// manifestOrIndex holds the descriptors of an image manifest, an artifact manifest or an index
+type manifestOrIndex struct {
+	Config    *ocispec.Descriptor  `json:"config,omitempty"`
+	Layers    []ocispec.Descriptor `json:"layers,omitempty"`
+	Blobs     []ocispec.Descriptor `json:"blobs,omitempty"`
+	Manifests []ocispec.Descriptor `json:"manifests,omitempty"`
+}
+
+// isManifest reports whether mediaType identifies a single image manifest
+func isManifest(mediaType string) bool {
+	switch mediaType {
+	case ocispec.MediaTypeImageManifest, consts.DockerManifestSchema2:
+		return true
+	}
+	return false
+}
+
+func (l *Layout) writeBlobData(data []byte) (bool, error) {
+	blob := static.NewLayer(data, "") // NOTE: MediaType isn't actually used in the writing
+	return l.writeLayer(blob)
+}
+
+// writeLayer writes the compressed content of layer to the store's blobs
+// 	Content is staged in an ingest file and checkpointed as it is written, so a write that fails partway through is
+// 	resumed from its last checkpoint the next time the same layer is written.  The digest is always verified before the
+// 	blob is moved into place.  The returned bool reports whether the blob was written rather than already present.
+func (l *Layout) writeLayer(layer v1.Layer) (bool, error) {
+	d, err := layer.Digest()
+	if err != nil {
+		return false, err
+	}
 
 	dir := filepath.Join(l.Root, "blobs", d.Algorithm)
 	if err := os.MkdirAll(dir, os.ModePerm); err != nil && !os.IsExist(err) {
-		return err
+		return false, err
 	}
 
+	// a concurrent writer of the same blob shares its ingest, wait for it to finish rather than clobbering it
+	unlock := l.writes.lock(d.String())
+	defer unlock()
+
 	blobPath := filepath.Join(dir, d.Hex)
 	// Skip entirely if something exists, assume layer is present already
 	if _, err := os.Stat(blobPath); err == nil {
-		return nil
+		return false, nil
 	}
 
-	w, err := os.Create(blobPath)
+	r, err := layer.Compressed()
 	if err != nil {
-		return err
+		return false, err
 	}
-	defer w.Close()
+	defer r.Close()
 
-	_, err = io.Copy(w, r)
-	return err
+	in, err := l.openIngest(d)
+	if err != nil {
+		return false, fmt.Errorf("open ingest: %w", err)
+	}
+
+	if err := in.skip(r); err != nil {
+		in.discard()
+		return false, fmt.Errorf("resume ingest: %w", err)
+	}
+
+	if _, err := io.Copy(in, r); err != nil {
+		if cerr := in.abort(); cerr != nil {
+			return false, fmt.Errorf("%w (checkpoint: %v)", err, cerr)
+		}
+		return false, err
+	}
+
+	if err := in.commit(d, blobPath); err != nil {
+		return false, err
+	}
+	return true, nil
 }
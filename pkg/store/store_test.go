@@ -1,14 +1,27 @@
 package store_test
 
 import (
+	"bytes"
 	"context"
+	"io"
 	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"testing"
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/partial"
 	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"oras.land/oras-go/pkg/target"
 
 	"github.com/rancherfederal/ocil/pkg/artifacts"
+	"github.com/rancherfederal/ocil/pkg/artifacts/memory"
+	"github.com/rancherfederal/ocil/pkg/consts"
+	"github.com/rancherfederal/ocil/pkg/content"
 	"github.com/rancherfederal/ocil/pkg/store"
 )
 
@@ -62,6 +75,205 @@ func TestLayout_AddOCI(t *testing.T) {
 	}
 }
 
+func TestLayout_ReferencesWithMediaType(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	s, err := store.NewLayout(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deprecated := "application/vnd.example.config.v1+json"
+	contents := map[string]artifacts.OCI{
+		"mem/deprecated-config:v1": memory.NewMemory([]byte("a"), "text/plain", memory.WithConfig(struct{}{}, deprecated)),
+		"mem/deprecated-layer:v1":  memory.NewMemory([]byte("b"), deprecated),
+		"mem/current:v1":           memory.NewMemory([]byte("c"), "text/plain"),
+		"image/random:v1":          genArtifact(t, "image/random:v1"),
+	}
+	for ref, a := range contents {
+		if _, err := s.AddOCI(ctx, a, ref); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name      string
+		mediaType string
+		want      []string
+	}{
+		{
+			name:      "should match config and layer media types",
+			mediaType: deprecated,
+			want:      []string{"mem/deprecated-config:v1", "mem/deprecated-layer:v1"},
+		},
+		{
+			name:      "should match image config media types",
+			mediaType: consts.DockerConfigJSON,
+			want:      []string{"image/random:v1"},
+		},
+		{
+			name:      "should match nothing for unused media types",
+			mediaType: "application/vnd.example.unused",
+			want:      nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := s.ReferencesWithMediaType(ctx, tt.mediaType)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ReferencesWithMediaType() got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLayout_OpenIndex(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	s, err := store.NewLayout(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.AddOCI(ctx, genArtifact(t, "hello/world:v1"), "hello/world:v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	rc, size, err := s.OpenIndex(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want, err := os.ReadFile(filepath.Join(root, consts.OCIImageIndexFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("OpenIndex() content does not match index on disk: got %s, want %s", got, want)
+	}
+	if size != int64(len(want)) {
+		t.Errorf("OpenIndex() unexpected size: got %d, want %d", size, len(want))
+	}
+}
+
+func TestLayout_CopyAll_WithRouter(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	s, err := store.NewLayout(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the total size is every blob the reference is made of, the manifest, config and layers
+	want := make(map[string]int64)
+	for ref, m := range map[string]*memory.Memory{
+		"route/small:v1": memory.NewMemory([]byte("small"), "text/plain"),
+		"route/large:v1": memory.NewMemory(make([]byte, 16<<10), "text/plain"),
+	} {
+		desc, err := s.AddOCI(ctx, m, ref)
+		if err != nil {
+			t.Fatal(err)
+		}
+		manifest, err := m.Manifest()
+		if err != nil {
+			t.Fatal(err)
+		}
+		want[ref] = desc.Size + manifest.Config.Size
+		for _, lyr := range manifest.Layers {
+			want[ref] += lyr.Size
+		}
+	}
+
+	bulk := newTarget(t)
+	small := newTarget(t)
+
+	sizes := make(map[string]int64)
+	router := func(ref string, desc ocispec.Descriptor, totalSize int64) (target.Target, string, error) {
+		sizes[ref] = totalSize
+		if totalSize > 8192 {
+			return bulk, "bulk/" + ref, nil
+		}
+		return small, "", nil
+	}
+
+	descs, err := s.CopyAll(ctx, nil, nil, store.WithRouter(router))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(descs) != 2 {
+		t.Fatalf("expected 2 copied references, got %d", len(descs))
+	}
+
+	if !reflect.DeepEqual(sizes, want) {
+		t.Errorf("unexpected total sizes: got %v, want %v", sizes, want)
+	}
+
+	if got, want := targetRefs(t, bulk), []string{"bulk/route/large:v1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected bulk references: got %v, want %v", got, want)
+	}
+	if got, want := targetRefs(t, small), []string{"route/small:v1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected small references: got %v, want %v", got, want)
+	}
+}
+
+func TestLayout_CopyAll_NoTarget(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	s, err := store.NewLayout(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.AddOCI(ctx, memory.NewMemory([]byte("unrouted"), "text/plain"), "route/unrouted:v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	router := func(ref string, desc ocispec.Descriptor, totalSize int64) (target.Target, string, error) {
+		return nil, "", nil
+	}
+	if _, err := s.CopyAll(ctx, nil, nil, store.WithRouter(router)); err == nil {
+		t.Error("expected an error when neither the router nor CopyAll gives a target")
+	}
+}
+
+func newTarget(t *testing.T) *content.OCI {
+	dir, err := os.MkdirTemp(root, "target")
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := content.NewOCI(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return o
+}
+
+func targetRefs(t *testing.T, o *content.OCI) []string {
+	var refs []string
+	err := o.Walk(func(reference string, desc ocispec.Descriptor) error {
+		refs = append(refs, reference)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(refs)
+	return refs
+}
+
 func setup(t *testing.T) func() error {
 	tmpdir, err := os.MkdirTemp("", "ocil")
 	if err != nil {
@@ -103,3 +315,52 @@ func genArtifact(t *testing.T, ref string) artifacts.OCI {
 		img,
 	}
 }
+
+// layersArtifact is an artifacts.OCI composed of arbitrary pre-built layers
+type layersArtifact struct {
+	config []byte
+	layers []v1.Layer
+}
+
+func newLayersArtifact(layers ...v1.Layer) *layersArtifact {
+	return &layersArtifact{
+		config: []byte(`{}`),
+		layers: layers,
+	}
+}
+
+func (a *layersArtifact) MediaType() string {
+	return consts.OCIManifestSchema1
+}
+
+func (a *layersArtifact) Manifest() (*v1.Manifest, error) {
+	cfg := static.NewLayer(a.config, consts.UnknownManifest)
+	cfgDesc, err := partial.Descriptor(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	var descs []v1.Descriptor
+	for _, l := range a.layers {
+		desc, err := partial.Descriptor(l)
+		if err != nil {
+			return nil, err
+		}
+		descs = append(descs, *desc)
+	}
+
+	return &v1.Manifest{
+		SchemaVersion: 2,
+		MediaType:     types.MediaType(a.MediaType()),
+		Config:        *cfgDesc,
+		Layers:        descs,
+	}, nil
+}
+
+func (a *layersArtifact) RawConfig() ([]byte, error) {
+	return a.config, nil
+}
+
+func (a *layersArtifact) Layers() ([]v1.Layer, error) {
+	return a.layers, nil
+}
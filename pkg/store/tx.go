@@ -0,0 +1,163 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/rancherfederal/ocil/pkg/artifacts"
+)
+
+// ErrTxDone is returned by any operation on a transaction that has already been committed or rolled back
+var ErrTxDone = errors.New("transaction has already been committed or rolled back")
+
+// Tx is a set of references that are added to the store all together or not at all
+// 	Blobs are staged in the store as each reference is added, but the index is only updated once on Commit.  Until
+// 	then every blob the transaction depends on is held, so neither another transaction's Rollback nor GC removes it.
+// 	Rollback removes the blobs the transaction staged that nothing in the index refers to and nothing else holds.
+type Tx struct {
+	l *Layout
+
+	mu     sync.Mutex
+	descs  map[string]ocispec.Descriptor
+	held   []digest.Digest
+	staged []digest.Digest
+	err    error
+	done   bool
+}
+
+// Begin starts a new transaction against the store
+func (l *Layout) Begin() *Tx {
+	return &Tx{
+		l:     l,
+		descs: make(map[string]ocispec.Descriptor),
+	}
+}
+
+// AddOCI stages an artifacts.OCI to be added to the store as ref when the transaction is committed
+// 	If it fails, the transaction can no longer be committed
+func (tx *Tx) AddOCI(ctx context.Context, oci artifacts.OCI, ref string) (ocispec.Descriptor, error) {
+	tx.mu.Lock()
+	if tx.done {
+		tx.mu.Unlock()
+		return ocispec.Descriptor{}, ErrTxDone
+	}
+	tx.mu.Unlock()
+
+	desc, held, written, err := tx.l.writeOCI(ctx, oci, ref)
+
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.held = append(tx.held, held...)
+	tx.staged = append(tx.staged, written...)
+	if err != nil {
+		if tx.err == nil {
+			tx.err = fmt.Errorf("%s: %w", ref, err)
+		}
+		return ocispec.Descriptor{}, err
+	}
+	tx.descs[ref] = desc
+	return desc, nil
+}
+
+// AddOCICollection stages every artifacts.OCI in the collection to be added to the store when the transaction is
+// committed
+func (tx *Tx) AddOCICollection(ctx context.Context, collection artifacts.OCICollection) ([]ocispec.Descriptor, error) {
+	cnts, err := collection.Contents()
+	if err != nil {
+		return nil, err
+	}
+
+	var descs []ocispec.Descriptor
+	for ref, oci := range cnts {
+		desc, err := tx.AddOCI(ctx, oci, ref)
+		if err != nil {
+			return nil, err
+		}
+		descs = append(descs, desc)
+	}
+	return descs, nil
+}
+
+// Commit adds every reference staged by the transaction to the index in a single update
+// 	If any reference failed to be staged, nothing is added, the transaction is rolled back and the first failure is
+// 	returned.  If the index cannot be updated the transaction is left open, so it can be committed again or rolled
+// 	back.
+func (tx *Tx) Commit(ctx context.Context) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return ErrTxDone
+	}
+
+	if tx.err != nil {
+		if err := tx.rollback(ctx); err != nil {
+			return fmt.Errorf("rollback: %v: %w", err, tx.err)
+		}
+		return fmt.Errorf("transaction aborted: %w", tx.err)
+	}
+
+	descs := make([]ocispec.Descriptor, 0, len(tx.descs))
+	for _, desc := range tx.descs {
+		descs = append(descs, desc)
+	}
+
+	if err := tx.l.OCI.AddIndexes(descs...); err != nil {
+		return fmt.Errorf("add index: %w", err)
+	}
+
+	tx.done = true
+	tx.l.holds.release(tx.held...)
+	return nil
+}
+
+// Rollback discards the transaction and removes the blobs it staged
+// 	Blobs that are referenced by the index, such as those shared with an existing reference, or held by another
+// 	transaction are left in place.  Partial writes of the blobs it depends on are removed along with their checkpoints.
+func (tx *Tx) Rollback(ctx context.Context) error {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	if tx.done {
+		return ErrTxDone
+	}
+	return tx.rollback(ctx)
+}
+
+func (tx *Tx) rollback(ctx context.Context) error {
+	tx.done = true
+	tx.l.holds.release(tx.held...)
+
+	// holding the lock keeps anyone from depending on a blob between checking it and removing it
+	return tx.l.holds.locked(func(held func(digest.Digest) bool) error {
+		referenced, err := tx.l.referencedBlobs(ctx)
+		if err != nil {
+			return err
+		}
+
+		for _, d := range tx.staged {
+			if _, ok := referenced[d]; ok || held(d) {
+				continue
+			}
+			blobPath := filepath.Join(tx.l.Root, "blobs", d.Algorithm().String(), d.Hex())
+			if err := os.RemoveAll(blobPath); err != nil {
+				return err
+			}
+		}
+
+		for _, d := range tx.held {
+			if held(d) {
+				continue
+			}
+			if err := tx.l.removeIngest(d); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
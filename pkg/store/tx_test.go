@@ -0,0 +1,258 @@
+package store_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/v1/static"
+	"github.com/google/go-containerregistry/pkg/v1/types"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+
+	"github.com/rancherfederal/ocil/pkg/artifacts/memory"
+	"github.com/rancherfederal/ocil/pkg/store"
+)
+
+func TestTx_Commit(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	s, err := store.NewLayout(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx := s.Begin()
+	if _, err := tx.AddOCI(ctx, memory.NewMemory([]byte("chart"), "text/plain"), "coupled/chart:v1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.AddOCI(ctx, genArtifact(t, "coupled/image:v1"), "coupled/image:v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// nothing is visible until the transaction is committed
+	if got := indexedRefs(t); len(got) != 0 {
+		t.Fatalf("expected no indexed references before commit, got %v", got)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"coupled/chart:v1", "coupled/image:v1"}
+	if got := indexedRefs(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected indexed references: got %v, want %v", got, want)
+	}
+
+	if err := tx.Commit(ctx); !errors.Is(err, store.ErrTxDone) {
+		t.Errorf("expected ErrTxDone on second commit, got %v", err)
+	}
+}
+
+func TestTx_Rollback(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	s, err := store.NewLayout(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	existing := memory.NewMemory([]byte("existing"), "text/plain")
+	if _, err := s.AddOCI(ctx, existing, "existing/content:v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	data := make([]byte, 1<<16)
+	if _, err := rand.Read(data); err != nil {
+		t.Fatal(err)
+	}
+	broken := &controlledLayer{Layer: static.NewLayer(data, types.OCIUncompressedLayer), data: data, failAt: 1 << 10}
+
+	tests := []struct {
+		name    string
+		finish  func(tx *store.Tx, ctx context.Context) error
+		wantErr bool
+	}{
+		{
+			name:    "should discard everything on explicit rollback",
+			finish:  (*store.Tx).Rollback,
+			wantErr: false,
+		},
+		{
+			name:    "should discard everything when committing a failed transaction",
+			finish:  (*store.Tx).Commit,
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			staged := memory.NewMemory([]byte("staged"), "text/plain")
+
+			tx := s.Begin()
+			if _, err := tx.AddOCI(ctx, staged, "coupled/staged:v1"); err != nil {
+				t.Fatal(err)
+			}
+			// shares all of its blobs with a reference already in the index
+			if _, err := tx.AddOCI(ctx, existing, "coupled/existing:v1"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tx.AddOCI(ctx, newLayersArtifact(broken), "coupled/broken:v1"); err == nil {
+				t.Fatal("expected broken artifact to fail")
+			}
+
+			if err := tt.finish(tx, ctx); (err != nil) != tt.wantErr {
+				t.Fatalf("unexpected error finishing transaction: got %v, wantErr %v", err, tt.wantErr)
+			}
+
+			want := []string{"existing/content:v1"}
+			if got := indexedRefs(t); !reflect.DeepEqual(got, want) {
+				t.Errorf("unexpected indexed references: got %v, want %v", got, want)
+			}
+
+			layers, err := staged.Layers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			d, err := layers[0].Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(root, "blobs", d.Algorithm, d.Hex)); !os.IsNotExist(err) {
+				t.Errorf("expected staged blob to be removed, got %v", err)
+			}
+
+			d, err = broken.Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, name := range []string{d.Hex, d.Hex + ".checkpoint"} {
+				if _, err := os.Stat(filepath.Join(root, "ingest", d.Algorithm, name)); !os.IsNotExist(err) {
+					t.Errorf("expected partial write %s to be removed, got %v", name, err)
+				}
+			}
+
+			layers, err = existing.Layers()
+			if err != nil {
+				t.Fatal(err)
+			}
+			d, err = layers[0].Digest()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(root, "blobs", d.Algorithm, d.Hex)); err != nil {
+				t.Errorf("expected shared blob to be kept: %v", err)
+			}
+		})
+	}
+}
+
+func TestTx_RollbackKeepsSharedBlobs(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	s, err := store.NewLayout(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	shared := memory.NewMemory([]byte("shared"), "text/plain")
+
+	tx1 := s.Begin()
+	if _, err := tx1.AddOCI(ctx, shared, "first/shared:v1"); err != nil {
+		t.Fatal(err)
+	}
+	tx2 := s.Begin()
+	if _, err := tx2.AddOCI(ctx, shared, "second/shared:v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// tx1 staged the blobs, but tx2 still depends on them
+	if err := tx1.Rollback(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx2.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"second/shared:v1"}
+	if got := indexedRefs(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected indexed references: got %v, want %v", got, want)
+	}
+	rc, err := s.OpenContent(ctx, "second/shared:v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	got, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "shared" {
+		t.Errorf("unexpected content: got %q, want %q", got, "shared")
+	}
+}
+
+func TestTx_CommitIndexFailure(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	s, err := store.NewLayout(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tx := s.Begin()
+	if _, err := tx.AddOCI(ctx, memory.NewMemory([]byte("chart"), "text/plain"), "coupled/chart:v1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// the index cannot be saved while its temporary file is a directory
+	tmp := filepath.Join(root, "index.json.tmp")
+	if err := os.Mkdir(tmp, os.ModePerm); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(ctx); err == nil {
+		t.Fatal("expected commit to fail")
+	}
+	if _, desc, err := s.Resolve(ctx, "coupled/chart:v1"); err == nil && desc.Digest != "" {
+		t.Errorf("expected failed commit to leave the reference out of the index, got %s", desc.Digest)
+	}
+
+	// the transaction is still open and can be committed once the index can be saved
+	if err := os.Remove(tmp); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"coupled/chart:v1"}
+	if got := indexedRefs(t); !reflect.DeepEqual(got, want) {
+		t.Errorf("unexpected indexed references: got %v, want %v", got, want)
+	}
+}
+
+// indexedRefs returns the sorted references in the index on disk
+func indexedRefs(t *testing.T) []string {
+	s, err := store.NewLayout(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var refs []string
+	err = s.Walk(func(reference string, desc ocispec.Descriptor) error {
+		refs = append(refs, reference)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(refs)
+	return refs
+}
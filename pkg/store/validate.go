@@ -0,0 +1,250 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+var (
+	// ErrCorruptBlob is returned for blobs whose content does not match their digest
+	ErrCorruptBlob = errors.New("content does not match digest")
+
+	// ErrMissingBlob is returned for referenced blobs that are not in the store, including corrupt blobs removed under
+	// CorruptPolicyMissing
+	ErrMissingBlob = errors.New("blob is missing")
+)
+
+// CorruptPolicy decides how Validate and GC treat a blob that is present but fails verification
+type CorruptPolicy int
+
+const (
+	// CorruptPolicyReport leaves the blob in place and reports it, this is the default
+	CorruptPolicyReport CorruptPolicy = iota
+
+	// CorruptPolicyKeep treats the blob as present, leaving it in place without reporting it
+	CorruptPolicyKeep
+
+	// CorruptPolicyMissing treats the blob as missing, removing it so adding its content again re-fetches it
+	CorruptPolicyMissing
+
+	// CorruptPolicyQuarantine moves the blob out of the blobs directory into quarantine and reports it
+	CorruptPolicyQuarantine
+)
+
+// WithCorruptPolicy sets how Validate and GC treat blobs that fail verification
+// 	Validate, ValidateSince and GC never run at the same time, and each removes or quarantines a corrupt blob the way GC
+// 	removes an unreferenced one.  A blob held by a write in progress or an open transaction, or replaced since it was
+// 	verified, is left in place and only reported.
+func WithCorruptPolicy(p CorruptPolicy) Options {
+	return func(l *Layout) {
+		l.corruptPolicy = p
+	}
+}
+
+// Validate verifies every blob in the store matches its digest and every referenced blob is present
+func (l *Layout) Validate(ctx context.Context) error {
+	defer l.collecting()()
+
+	referenced, err := l.referencedBlobs(ctx)
+	if err != nil {
+		return fmt.Errorf("referenced blobs: %w", err)
+	}
+	return l.validate(ctx, referenced, func(fs.FileInfo) bool { return true })
+}
+
+// ValidateSince verifies only the blobs in the store modified after since, returning the aggregated failures
+// 	This is a cheap integrity check after adding content, blobs that already existed are not read at all, and blobs
+// 	missing from the store are not looked for
+func (l *Layout) ValidateSince(ctx context.Context, since time.Time) error {
+	defer l.collecting()()
+	return l.validate(ctx, nil, func(fi fs.FileInfo) bool { return fi.ModTime().After(since) })
+}
+
+// validate verifies every blob include selects and checks that every one of referenced is present
+func (l *Layout) validate(ctx context.Context, referenced map[digest.Digest]int64, include func(fs.FileInfo) bool) error {
+	var errs blobErrors
+	present := make(map[digest.Digest]bool)
+	err := l.walkBlobs(func(path string, d digest.Digest, fi fs.FileInfo) error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		present[d] = true
+		if !include(fi) {
+			return nil
+		}
+		if err := l.verifyBlob(path, d, fi); err != nil {
+			errs = append(errs, err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("walk blobs: %w", err)
+	}
+	errs = append(errs, missingBlobs(referenced, present)...)
+	if errs != nil {
+		return errs
+	}
+	return nil
+}
+
+// missingBlobs reports every one of referenced that is not present, in digest order
+// 	Blobs handled by the CorruptPolicy were present, and so are not reported twice.
+func missingBlobs(referenced map[digest.Digest]int64, present map[digest.Digest]bool) blobErrors {
+	var ds []string
+	for d := range referenced {
+		if !present[d] {
+			ds = append(ds, d.String())
+		}
+	}
+	sort.Strings(ds)
+
+	var missing blobErrors
+	for _, d := range ds {
+		missing = append(missing, fmt.Errorf("%s: %w", d, ErrMissingBlob))
+	}
+	return missing
+}
+
+// blobErrors are the failures of several blobs, reported together
+// 	errors.Is and errors.As match against each of them, so ErrCorruptBlob and ErrMissingBlob can be checked for.
+type blobErrors []error
+
+func (e blobErrors) Error() string {
+	errst := make([]string, 0, len(e))
+	for _, err := range e {
+		errst = append(errst, err.Error())
+	}
+	return strings.Join(errst, "; ")
+}
+
+func (e blobErrors) Is(target error) bool {
+	for _, err := range e {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e blobErrors) As(target interface{}) bool {
+	for _, err := range e {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// Unwrap exposes every failure to errors.Is and errors.As directly from Go 1.20
+func (e blobErrors) Unwrap() []error {
+	return e
+}
+
+// walkBlobs calls fn for every blob file in the store along with the digest its path identifies
+func (l *Layout) walkBlobs(fn func(path string, d digest.Digest, fi fs.FileInfo) error) error {
+	blobs := filepath.Join(l.Root, "blobs")
+	err := filepath.WalkDir(blobs, func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == blobs {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if de.IsDir() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(blobs, path)
+		if err != nil {
+			return err
+		}
+		d := digest.Digest(strings.Replace(filepath.ToSlash(rel), "/", ":", 1))
+
+		fi, err := de.Info()
+		if err != nil {
+			return err
+		}
+		return fn(path, d, fi)
+	})
+	return err
+}
+
+// verifyBlob checks the content at path, last seen as fi, matches d, applying the store's CorruptPolicy if it does not
+// 	It must be called while collecting.
+func (l *Layout) verifyBlob(path string, d digest.Digest, fi fs.FileInfo) error {
+	err := checkBlob(path, d)
+	if !errors.Is(err, ErrCorruptBlob) {
+		return err
+	}
+
+	var apply func() error
+	switch l.corruptPolicy {
+	case CorruptPolicyKeep:
+		return nil
+
+	case CorruptPolicyMissing:
+		apply = func() error {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+			return fmt.Errorf("%s: %w", d, ErrMissingBlob)
+		}
+
+	case CorruptPolicyQuarantine:
+		apply = func() error {
+			dir := filepath.Join(l.Root, "quarantine", d.Algorithm().String())
+			if err := os.MkdirAll(dir, os.ModePerm); err != nil && !os.IsExist(err) {
+				return err
+			}
+			if err := os.Rename(path, filepath.Join(dir, d.Hex())); err != nil {
+				return err
+			}
+			return fmt.Errorf("quarantined: %w", err)
+		}
+
+	default:
+		return err
+	}
+
+	// only act on the blob that failed, and only while nobody depends on it, otherwise it is just reported
+	result := err
+	l.holds.unlessPinned(d, func() error {
+		if cur, err := os.Lstat(path); err == nil && os.SameFile(cur, fi) {
+			result = apply()
+		}
+		return nil
+	})
+	return result
+}
+
+// checkBlob checks the content at path matches d
+func checkBlob(path string, d digest.Digest) error {
+	if err := d.Validate(); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	v := d.Verifier()
+	if _, err := io.Copy(v, f); err != nil {
+		return fmt.Errorf("%s: %w", d, err)
+	}
+	if !v.Verified() {
+		return fmt.Errorf("%s: %w", d, ErrCorruptBlob)
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package store_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/rancherfederal/ocil/pkg/artifacts/memory"
+	"github.com/rancherfederal/ocil/pkg/store"
+)
+
+func TestLayout_ValidateSince(t *testing.T) {
+	teardown := setup(t)
+	defer teardown()
+
+	s, err := store.NewLayout(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	old := memory.NewMemory([]byte("old content"), "text/plain")
+	if _, err := s.AddOCI(ctx, old, "validate/old:v1"); err != nil {
+		t.Fatal(err)
+	}
+	oldPath := memoryBlobPath(t, old)
+
+	// corrupt the old blob, then age every existing blob so the only recent blobs are those of the next reference
+	since := time.Now().Add(-time.Minute)
+	if err := os.WriteFile(oldPath, []byte("corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = filepath.Walk(filepath.Join(root, "blobs"), func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		return os.Chtimes(path, since.Add(-time.Hour), since.Add(-time.Hour))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recent := memory.NewMemory([]byte("recent content"), "text/plain")
+	if _, err := s.AddOCI(ctx, recent, "validate/recent:v1"); err != nil {
+		t.Fatal(err)
+	}
+	recentPath := memoryBlobPath(t, recent)
+
+	if err := s.ValidateSince(ctx, since); err != nil {
+		t.Errorf("ValidateSince() should only check recent blobs, got %v", err)
+	}
+	if err := s.Validate(ctx); !errors.Is(err, store.ErrCorruptBlob) || !strings.Contains(err.Error(), filepath.Base(oldPath)) {
+		t.Errorf("Validate() should report the old corrupt blob, got %v", err)
+	}
+
+	// corrupting the recent blob is caught
+	if err := os.WriteFile(recentPath, []byte("corrupted"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err = s.ValidateSince(ctx, since)
+	if !errors.Is(err, store.ErrCorruptBlob) || !strings.Contains(err.Error(), filepath.Base(recentPath)) {
+		t.Fatalf("ValidateSince() should report the recent corrupt blob, got %v", err)
+	}
+	if strings.Contains(err.Error(), filepath.Base(oldPath)) {
+		t.Errorf("ValidateSince() should not check the old blob, got %v", err)
+	}
+}
+
+// memoryBlobPath returns the path of the single layer blob of a memory artifact within the store
+func memoryBlobPath(t *testing.T, m *memory.Memory) string {
+	layers, err := m.Layers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := layers[0].Digest()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filepath.Join(root, "blobs", d.Algorithm, d.Hex)
+}